@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// inherited holds the listening sockets passed by systemd socket activation
+// until a forward with a matching address claims them.
+var inherited struct {
+	sync.Mutex
+	ls []net.Listener
+}
+
+// loadInherited picks up sockets passed with the LISTEN_FDS protocol.
+func loadInherited() {
+	fds := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	inherited.Lock()
+	defer inherited.Unlock()
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd.fd), "LISTEN_FD_"+strconv.Itoa(fd.fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Println("socket activation: fd", fd.fd, err)
+			continue
+		}
+		if fd.name != "" {
+			log.Printf("socket activation: %s %s", fd.name, l.Addr())
+		} else {
+			log.Println("socket activation:", l.Addr())
+		}
+		inherited.ls = append(inherited.ls, l)
+	}
+}
+
+// listenFD is a file descriptor passed by socket activation and its
+// FileDescriptorName=, if any.
+type listenFD struct {
+	fd   int
+	name string
+}
+
+// listenFDs parses the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES values
+// into the descriptors passed to process pid. There are none when
+// LISTEN_PID names another process, e.g. an activated parent.
+func listenFDs(listenPID, count, names string, pid int) []listenFD {
+	if p, err := strconv.Atoi(listenPID); err != nil || p != pid {
+		return nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var named []string
+	if names != "" {
+		named = strings.Split(names, ":")
+	}
+	fds := make([]listenFD, n)
+	for i := range fds {
+		fds[i].fd = listenFDsStart + i
+		if i < len(named) {
+			fds[i].name = named[i]
+		}
+	}
+	return fds
+}
+
+// listen returns the inherited socket for addr, or binds addr when there is
+// none. An inherited socket on the unspecified address matches any host.
+func listen(addr string) (net.Listener, error) {
+	if a, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		inherited.Lock()
+		for i, l := range inherited.ls {
+			la, ok := l.Addr().(*net.TCPAddr)
+			if ok && la.Port == a.Port && (la.IP.Equal(a.IP) || la.IP.IsUnspecified()) {
+				inherited.ls = append(inherited.ls[:i], inherited.ls[i+1:]...)
+				inherited.Unlock()
+				return l, nil
+			}
+		}
+		inherited.Unlock()
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListenFDs(t *testing.T) {
+	const pid = 4242
+	for _, c := range []struct {
+		name             string
+		listenPID, count string
+		names            string
+		want             []listenFD
+	}{
+		{"ours", "4242", "2", "", []listenFD{{3, ""}, {4, ""}}},
+		{"named", "4242", "2", "ssh:git", []listenFD{{3, "ssh"}, {4, "git"}}},
+		{"fewer names", "4242", "2", "ssh", []listenFD{{3, "ssh"}, {4, ""}}},
+		{"other pid", "4243", "2", "ssh:git", nil},
+		{"no pid", "", "2", "", nil},
+		{"count 0", "4242", "0", "", nil},
+		{"negative count", "4242", "-1", "", nil},
+		{"bad count", "4242", "two", "", nil},
+	} {
+		if got := listenFDs(c.listenPID, c.count, c.names, pid); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/nobonobo/ssh-p2p/signaling"
+)
+
+// aeadName is the cipher -aead negotiates for the tunneled stream, inside
+// the DTLS of the data channel.
+const aeadName = "aes-256-gcm"
+
+const (
+	aeadSaltSize = 16
+	aeadInfo     = "ssh-p2p aead v1 "
+)
+
+var (
+	// aeadRequired is -aead: a client asks for it, a server refuses
+	// clients that do not. A server without it still accepts clients
+	// asking for it.
+	aeadRequired bool
+	// psk is the -key, which unlike the room id signaling never sees.
+	psk *string
+)
+
+// aeadStream seals or opens the messages of one direction. The nonce
+// counts messages, so a key serves one direction of one session only.
+type aeadStream struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newAEADStream(key []byte) (*aeadStream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadStream{aead: gcm}, nil
+}
+
+func (a *aeadStream) nonce() []byte {
+	nonce := make([]byte, a.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], a.n)
+	a.n++
+	return nonce
+}
+
+func (a *aeadStream) seal(b []byte) []byte {
+	return a.aead.Seal(nil, a.nonce(), b, nil)
+}
+
+func (a *aeadStream) open(b []byte) ([]byte, error) {
+	data, err := a.aead.Open(nil, a.nonce(), b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: aead: message %d failed authentication", errAuthRejected, a.n-1)
+	}
+	return data, nil
+}
+
+// aeadKey derives the key of one direction from the -key and both salts,
+// HKDF-SHA256 style.
+func aeadKey(clientSalt, serverSalt []byte, dir string) []byte {
+	extract := hmac.New(sha256.New, append(append([]byte{}, clientSalt...), serverSalt...))
+	extract.Write([]byte(*psk))
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(aeadInfo + dir))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// aeadTunnel is the -aead state of a session.
+type aeadTunnel struct {
+	salt       []byte
+	send, recv *aeadStream
+}
+
+// wantAEAD makes s ask for, or agree to, -aead in its next message.
+func (s *session) wantAEAD() error {
+	salt := make([]byte, aeadSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.aead = &aeadTunnel{salt: salt}
+	s.mu.Unlock()
+	return nil
+}
+
+// helloAEAD adds the -aead offer or agreement of s to info.
+func (s *session) helloAEAD(info *signaling.ConnectInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aead != nil {
+		info.AEAD = aeadName
+		info.Salt = s.aead.salt
+	}
+}
+
+// acceptAEAD answers the -aead choice of a client message, on the server.
+func (s *session) acceptAEAD(v signaling.ConnectInfo) error {
+	switch v.AEAD {
+	case "":
+		if aeadRequired {
+			return fmt.Errorf("%w: client %s did not turn on -aead", errAuthRejected, v.Source)
+		}
+		return nil
+	case aeadName:
+	default:
+		return fmt.Errorf("%w: unsupported aead %q", errAuthRejected, v.AEAD)
+	}
+	if err := s.wantAEAD(); err != nil {
+		return err
+	}
+	return s.keyAEAD(v.Salt, false)
+}
+
+// confirmAEAD checks the server's reply against what the client asked
+// for; a reply without -aead may have been stripped on the way.
+func (s *session) confirmAEAD(v signaling.ConnectInfo) error {
+	s.mu.Lock()
+	want := s.aead != nil
+	s.mu.Unlock()
+	switch {
+	case !want && v.AEAD == "":
+		return nil
+	case !want:
+		return fmt.Errorf("%w: server sent aead %q the client did not ask for", errAuthRejected, v.AEAD)
+	case v.AEAD != aeadName:
+		return fmt.Errorf("%w: server did not agree to -aead", errAuthRejected)
+	}
+	return s.keyAEAD(v.Salt, true)
+}
+
+// keyAEAD sets up both directions from the peer's salt.
+func (s *session) keyAEAD(peerSalt []byte, client bool) error {
+	if len(peerSalt) != aeadSaltSize {
+		return fmt.Errorf("%w: aead salt of %d bytes, want %d", errAuthRejected, len(peerSalt), aeadSaltSize)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clientSalt, serverSalt := s.aead.salt, peerSalt
+	sendDir, recvDir := "client", "server"
+	if !client {
+		clientSalt, serverSalt = peerSalt, s.aead.salt
+		sendDir, recvDir = recvDir, sendDir
+	}
+	send, err := newAEADStream(aeadKey(clientSalt, serverSalt, sendDir))
+	if err != nil {
+		return err
+	}
+	recv, err := newAEADStream(aeadKey(clientSalt, serverSalt, recvDir))
+	if err != nil {
+		return err
+	}
+	s.aead.send, s.aead.recv = send, recv
+	return nil
+}
+
+// aeadStreams returns the ciphers of s, nil without -aead. It fails when
+// -aead was asked for but never keyed, rather than send in the clear.
+func (s *session) aeadStreams() (send, recv *aeadStream, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.aead == nil:
+		return nil, nil, nil
+	case s.aead.send == nil:
+		return nil, nil, fmt.Errorf("%w: -aead was not negotiated", errAuthRejected)
+	}
+	return s.aead.send, s.aead.recv, nil
+}
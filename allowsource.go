@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// allowSources is -allow-source: when set, the client's listeners close
+// connections from addresses outside these networks at accept time.
+var allowSources cidrsFlag
+
+// cidrsFlag is a repeatable, comma separated list of networks in CIDR
+// notation; a bare address stands for itself.
+type cidrsFlag []*net.IPNet
+
+func (f *cidrsFlag) String() string {
+	s := make([]string, len(*f))
+	for i, n := range *f {
+		s[i] = n.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *cidrsFlag) Set(v string) error {
+	for _, c := range strings.Split(v, ",") {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return fmt.Errorf("invalid address %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			c = fmt.Sprintf("%s/%d", c, bits)
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return err
+		}
+		*f = append(*f, n)
+	}
+	return nil
+}
+
+// allows reports whether a connection from addr may use the tunnel.
+func (f cidrsFlag) allows(addr net.Addr) bool {
+	if len(f) == 0 {
+		return true
+	}
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range f {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
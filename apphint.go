@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// appHint is -app-hint, the application tunneled by forwards without an
+// app= option. It only changes what is logged when a session fails: the
+// application then reports a generic error of its own, such as git's
+// "the remote end hung up unexpectedly".
+var appHint string
+
+// appHints are the -app-hint values.
+var appHints = map[string]bool{"git": true, "ssh": true}
+
+// maxAppPeek bounds the leading bytes of each direction kept to name
+// what was tunneled.
+const maxAppPeek = 512
+
+// appWatch follows the bytes of a session with an -app-hint, without
+// changing them, to explain a failure in the application's terms.
+type appWatch struct {
+	hint string
+
+	mu         sync.Mutex
+	sent, recv int64
+	req, reply []byte
+}
+
+func appHintError(hint string) error {
+	return fmt.Errorf("unknown app hint %q, want git or ssh", hint)
+}
+
+func peek(buf []byte, b []byte) []byte {
+	if n := maxAppPeek - len(buf); n > 0 {
+		if len(b) > n {
+			b = b[:n]
+		}
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+// appReader returns conn, counting what the local application sends
+// when s has an -app-hint.
+func (s *session) appReader(conn io.Reader) io.Reader {
+	if s.app == nil {
+		return conn
+	}
+	return appSent{conn, s.app}
+}
+
+type appSent struct {
+	io.Reader
+	w *appWatch
+}
+
+func (r appSent) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.w.mu.Lock()
+	r.w.sent += int64(n)
+	r.w.req = peek(r.w.req, b[:n])
+	r.w.mu.Unlock()
+	return n, err
+}
+
+// appReceived counts data from the server for the -app-hint of s.
+func (s *session) appReceived(data []byte) {
+	if s.app == nil {
+		return
+	}
+	s.app.mu.Lock()
+	s.app.recv += int64(len(data))
+	s.app.reply = peek(s.app.reply, data)
+	s.app.mu.Unlock()
+}
+
+// request names what the local application asked for: a git:// service
+// and repository, or an SSH connection.
+func (w *appWatch) request() string {
+	switch {
+	case bytes.HasPrefix(w.req, []byte("SSH-")):
+		if w.hint == "git" {
+			return "git over ssh"
+		}
+		return "the ssh connection"
+	case w.hint == "git" && len(w.req) > 4:
+		// a git:// request is one pkt-line: a 4 hex digit length, then
+		// "git-upload-pack /repo\x00host=...\x00".
+		line := w.req[4:]
+		if i := bytes.IndexByte(line, 0); i >= 0 {
+			line = line[:i]
+		}
+		if f := strings.Fields(string(line)); len(f) == 2 && strings.HasPrefix(f[0], "git-") {
+			return fmt.Sprintf("%s %q", f[0], f[1])
+		}
+	}
+	return "the " + w.hint + " connection"
+}
+
+// diagnoseApp explains in the application's terms why s went down; err is
+// the recorded reason, nil for an orderly close.
+func (s *session) diagnoseApp(open bool, err error) {
+	w := s.app
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	req := w.request()
+	switch {
+	case !open:
+		if err == nil {
+			err = fmt.Errorf("session closed first")
+		}
+		s.logf("%s: tunnel for %s not established: %v; the %s error that follows is this, not the server's", w.hint, req, err, w.hint)
+	case w.recv == 0:
+		s.logf("%s: tunnel up but nothing came back for %s; check a %s server listens at the server's -dial or route target", w.hint, req, w.hint)
+	case w.hint == "ssh" && !sshIdent(w.reply):
+		s.logf("ssh: the server's target answered with something other than SSH (%q); check its -dial or route", firstLine(w.reply))
+	case err != nil:
+		s.logf("%s: tunnel failed during %s after %d bytes sent, %d received: %v; the %s error that follows is this, not the server's", w.hint, req, w.sent, w.recv, err, w.hint)
+	}
+}
+
+// sshIdent reports whether b holds an SSH identification, which lines
+// of other text may precede.
+func sshIdent(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("SSH-")) || bytes.Contains(b, []byte("\nSSH-"))
+}
+
+func firstLine(b []byte) string {
+	if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+		b = b[:i]
+	}
+	if len(b) > 64 {
+		b = b[:64]
+	}
+	return string(b)
+}
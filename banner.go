@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// maxBanner bounds the -banner-file a server sends, in bytes.
+const maxBanner = 1024
+
+// banner is the server's -banner-file, sent to clients with each answer
+// or offer and re-read with -allow-peers.
+var banner struct {
+	sync.Mutex
+	file string
+	text string
+}
+
+func loadBanner() error {
+	banner.Lock()
+	defer banner.Unlock()
+	if banner.file == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(banner.file)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxBanner {
+		return fmt.Errorf("-banner-file %s: %d bytes, at most %d", banner.file, len(b), maxBanner)
+	}
+	banner.text = string(b)
+	return nil
+}
+
+func currentBanner() string {
+	banner.Lock()
+	defer banner.Unlock()
+	return banner.text
+}
+
+// shown is the banner the client printed last.
+var shown struct {
+	sync.Mutex
+	text string
+}
+
+// showBanner prints a server's banner to stderr, which leaves stdout to
+// -stdio, once until it changes rather than for every connection.
+func showBanner(text string) {
+	text = cleanBanner(text)
+	if text == "" {
+		return
+	}
+	shown.Lock()
+	defer shown.Unlock()
+	if text == shown.text {
+		return
+	}
+	shown.text = text
+	fmt.Fprint(os.Stderr, text)
+}
+
+// cleanBanner drops control characters, such as terminal escapes, other
+// than newlines and tabs from a banner, capped at maxBanner bytes.
+func cleanBanner(text string) string {
+	if len(text) > maxBanner {
+		text = text[:maxBanner]
+	}
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) && r != unicode.ReplacementChar {
+			return r
+		}
+		return -1
+	}, text)
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
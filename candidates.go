@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+var (
+	maxCandidates int
+	showPublicIP  bool
+)
+
+// candidateRank orders candidate types, most likely to connect first.
+var candidateRank = map[string]int{"relay": 0, "srflx": 1, "prflx": 2, "host": 3}
+
+// limitCandidates keeps the max best ICE candidates of sdp, preferring
+// relay and srflx over host and, so that both peers tend to keep the same
+// family, IPv4 over IPv6 (the other way around with -prefer-ipv6).
+// Component lines of one address count as one candidate. max <= 0 keeps
+// all.
+func limitCandidates(sdp string, max int) string {
+	if max <= 0 {
+		return sdp
+	}
+	lines := strings.Split(sdp, "\r\n")
+	type candidate struct {
+		key  string
+		rank int
+	}
+	var order []candidate
+	seen := map[string]bool{}
+	for _, line := range lines {
+		key, typ, ok := parseCandidate(line)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		rank, known := candidateRank[typ]
+		if !known {
+			rank = len(candidateRank)
+		}
+		rank *= 2
+		if strings.Contains(key, ":") != preferIPv6 {
+			rank++
+		}
+		order = append(order, candidate{key, rank})
+	}
+	if len(order) <= max {
+		return sdp
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].rank < order[j].rank })
+	keep := map[string]bool{}
+	for _, c := range order[:max] {
+		keep[c.key] = true
+	}
+	var out []string
+	for _, line := range lines {
+		if key, _, ok := parseCandidate(line); ok && !keep[key] {
+			continue
+		}
+		out = append(out, line)
+	}
+	log.Printf("ice candidates: gathered %d, kept %d", len(order), max)
+	return strings.Join(out, "\r\n")
+}
+
+// srflxAddrs returns the server reflexive (public, as seen by STUN)
+// addresses among sdp's candidates.
+func srflxAddrs(sdp string) []string {
+	var addrs []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(sdp, "\r\n") {
+		_, typ, ok := parseCandidate(line)
+		if !ok || typ != "srflx" {
+			continue
+		}
+		f := strings.Fields(line)
+		addr := net.JoinHostPort(f[4], f[5])
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// candidateAddr returns the public address of the peer that sent sdp: its
+// first server reflexive candidate, or else its first candidate.
+func candidateAddr(sdp string) string {
+	if addrs := srflxAddrs(sdp); len(addrs) > 0 {
+		return addrs[0]
+	}
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if _, _, ok := parseCandidate(line); ok {
+			f := strings.Fields(line)
+			return net.JoinHostPort(f[4], f[5])
+		}
+	}
+	return ""
+}
+
+// parseCandidate returns the transport address and type of an
+// a=candidate line.
+func parseCandidate(line string) (key, typ string, ok bool) {
+	if !strings.HasPrefix(line, "a=candidate:") {
+		return "", "", false
+	}
+	f := strings.Fields(line)
+	if len(f) < 8 || f[6] != "typ" {
+		return "", "", false
+	}
+	return f[2] + " " + f[4] + " " + f[5], f[7], true
+}
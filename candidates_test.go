@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSDP = "v=0\r\n" +
+	"m=application 9 DTLS/SCTP 5000\r\n" +
+	"a=candidate:1 1 udp 2130706431 192.168.1.2 50000 typ host\r\n" +
+	"a=candidate:1 2 udp 2130706431 192.168.1.2 50000 typ host\r\n" +
+	"a=candidate:2 1 udp 2130706431 fd00::2 50001 typ host\r\n" +
+	"a=candidate:3 1 udp 1694498815 203.0.113.7 61000 typ srflx raddr 0.0.0.0 rport 50000\r\n" +
+	"a=candidate:4 1 udp 16777215 198.51.100.9 3478 typ relay raddr 0.0.0.0 rport 50000\r\n" +
+	"a=end-of-candidates\r\n"
+
+func FuzzCandidates(f *testing.F) {
+	f.Add(testSDP, 1)
+	f.Add(testSDP, 3)
+	f.Add("a=candidate:1 1 udp 1 ::1 1 typ", 1)
+	f.Add("a=candidate:\r\n\r\n", 0)
+	f.Fuzz(func(t *testing.T, sdp string, max int) {
+		candidateAddr(sdp)
+		out := limitCandidates(sdp, max)
+		in := map[string]bool{}
+		var other int
+		for _, line := range strings.Split(sdp, "\r\n") {
+			in[line] = true
+			if _, _, ok := parseCandidate(line); !ok {
+				other++
+			}
+		}
+		kept := map[string]bool{}
+		for _, line := range strings.Split(out, "\r\n") {
+			if !in[line] {
+				t.Fatalf("line %q not in the sdp", line)
+			}
+			if key, _, ok := parseCandidate(line); ok {
+				kept[key] = true
+			} else {
+				other--
+			}
+		}
+		if other != 0 {
+			t.Fatalf("limitCandidates(%q, %d) dropped other lines", sdp, max)
+		}
+		if max > 0 && len(kept) > max {
+			t.Fatalf("limitCandidates(%q, %d) kept %d candidates", sdp, max, len(kept))
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The control protocol is one JSON request per line on a unix socket,
+// answered by one JSON response line:
+//
+//	{"cmd": "close", "args": ["<session id>"]}
+//	{"ok": true, "result": ...} or {"ok": false, "error": "..."}
+type controlRequest struct {
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args,omitempty"`
+}
+
+type controlResponse struct {
+	OK     bool        `json:"ok"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// controlCommands are the commands the running instance answers; server
+// and client add their own to the common ones.
+var controlCommands = map[string]func(args []string) (interface{}, error){
+	"status": func(args []string) (interface{}, error) {
+		status := map[string]interface{}{}
+		for name, f := range statusFuncs {
+			status[name] = f()
+		}
+		return status, nil
+	},
+	"close": func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: close <session id>")
+		}
+		sessions.Lock()
+		s, ok := sessions.m[args[0]]
+		sessions.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("no such session: %s", args[0])
+		}
+		return nil, s.Close()
+	},
+	// reconnect drops every PeerConnection; listeners stay up, so the next
+	// local connection negotiates a fresh one.
+	"reconnect": func(args []string) (interface{}, error) {
+		list := listSessions()
+		for _, s := range list {
+			s.Close()
+		}
+		return len(list), nil
+	},
+}
+
+// instanceCommands are added to controlCommands by a running server or
+// client, so ctl knows only their names.
+var instanceCommands = []string{"pause", "reload", "resume"}
+
+// statusFuncs contribute the sections of the status command.
+var statusFuncs = map[string]func() interface{}{
+	"sessions": func() interface{} {
+		infos := []sessionInfo{}
+		for _, s := range listSessions() {
+			infos = append(infos, s.info())
+		}
+		return infos
+	},
+}
+
+func serveControl(path string) {
+	if path == "" {
+		return
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := listenPrivate(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("control socket:", path)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			go handleControl(conn)
+		}
+	}()
+}
+
+// listenPrivate listens on a unix socket at path that only this user can
+// connect to. The socket is bound in a fresh 0700 directory and made 0600
+// there before it is moved into place, so it is never open to others.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+	s := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for s.Scan() {
+		var req controlRequest
+		var res controlResponse
+		if err := json.Unmarshal(s.Bytes(), &req); err != nil {
+			res.Error = err.Error()
+		} else if f, ok := controlCommands[req.Cmd]; !ok {
+			res.Error = "unknown command: " + req.Cmd
+		} else if v, err := f(req.Args); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.OK, res.Result = true, v
+		}
+		if err := enc.Encode(res); err != nil {
+			return
+		}
+	}
+}
+
+// ctl sends one command to a running instance and prints the result.
+func ctl(path string, args []string) error {
+	if len(args) == 0 {
+		cmds := append([]string{}, instanceCommands...)
+		for name := range controlCommands {
+			cmds = append(cmds, name)
+		}
+		sort.Strings(cmds)
+		return fmt.Errorf("missing command, one of %v", cmds)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(controlRequest{Cmd: args[0], Args: args[1:]}); err != nil {
+		return err
+	}
+	var res controlResponse
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return err
+	}
+	if !res.OK {
+		return fmt.Errorf("%s", res.Error)
+	}
+	if res.Result != nil {
+		b, err := json.MarshalIndent(res.Result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
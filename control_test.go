@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlSocketMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ctl.sock")
+	serveControl(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Fatalf("control socket mode %o, want 600", mode)
+	}
+	if err := ctl(path, []string{"status"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d entries left next to the socket, want only it", len(entries))
+	}
+}
+
+func TestCtlMissingCommand(t *testing.T) {
+	err := ctl("", nil)
+	if err == nil {
+		t.Fatal("no error without a command")
+	}
+	for _, cmd := range []string{"close", "pause", "reconnect", "reload", "resume", "status"} {
+		if !strings.Contains(err.Error(), cmd) {
+			t.Errorf("usage %q does not list %s", err, cmd)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// Failure classes of connection setup. Errors wrap one of these, test with
+// errors.Is:
+//
+//	errSignaling    the signaling server could not be reached or refused us
+//	errICEFailed    the peer connection went down before the tunnel opened
+//	errAuthRejected the peer identity or requested destination is not allowed
+//	errTimeout      the tunnel did not open in time
+var (
+	errSignaling    = errors.New("signaling failed")
+	errICEFailed    = errors.New("ice failed")
+	errAuthRejected = errors.New("auth rejected")
+	errTimeout      = errors.New("timeout")
+)
+
+// Process exit codes. A signal initiated shutdown exits 0.
+const (
+	exitFailure     = 1 // anything not classified below
+	exitConfig      = 2 // bad flags or unusable config files
+	exitSignaling   = 3
+	exitICE         = 4
+	exitAuth        = 5
+	exitTimeout     = 6
+	exitUnreachable = 7 // client gave up after -reconnect-max-attempts
+	exitKeyRotated  = 8 // the -vault-path key changed, restart to use it
+)
+
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errSignaling):
+		return exitSignaling
+	case errors.Is(err, errICEFailed):
+		return exitICE
+	case errors.Is(err, errAuthRejected):
+		return exitAuth
+	case errors.Is(err, errTimeout):
+		return exitTimeout
+	}
+	return exitFailure
+}
+
+// fatal logs err and exits with its class's code.
+func fatal(err error) {
+	atomic.StoreInt32(&exiting, 1)
+	log.Output(2, err.Error())
+	os.Exit(exitCode(err))
+}
+
+// fatalConfig logs v and exits with exitConfig.
+func fatalConfig(v ...interface{}) {
+	atomic.StoreInt32(&exiting, 1)
+	log.Output(2, fmt.Sprintln(v...))
+	os.Exit(exitConfig)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// preferIPv6 is -prefer-ipv6: a client first advertises only its IPv6
+	// candidates, which on dual-stack networks often connect directly
+	// where IPv4 needs a relay behind CGNAT. pions/webrtc v1.2.0 ignores
+	// candidate priorities, so leaving IPv4 out is the only way to bias it.
+	preferIPv6 bool
+	// ipv6Timeout is how long the IPv6 attempt may take to connect before
+	// the client falls back to IPv4.
+	ipv6Timeout = 5 * time.Second
+)
+
+const (
+	familyIPv4 = "IPv4"
+	familyIPv6 = "IPv6"
+)
+
+var errNoIPv6 = fmt.Errorf("%w: no IPv6 path (-prefer-ipv6)", errICEFailed)
+
+// candidateFamily returns the address family of a candidate key from
+// parseCandidate.
+func candidateFamily(key string) string {
+	if strings.Contains(key, ":") {
+		return familyIPv6
+	}
+	return familyIPv4
+}
+
+// keepFamily drops the candidates of sdp not of family. It returns sdp
+// as is when that leaves none.
+func keepFamily(sdp, family string) string {
+	lines := strings.Split(sdp, "\r\n")
+	var out []string
+	kept := false
+	for _, line := range lines {
+		if key, _, ok := parseCandidate(line); ok {
+			if candidateFamily(key) != family {
+				continue
+			}
+			kept = true
+		}
+		out = append(out, line)
+	}
+	if !kept {
+		return sdp
+	}
+	return strings.Join(out, "\r\n")
+}
+
+// sdpFamily returns the family of all candidates of sdp, or "" when they
+// are of both.
+func sdpFamily(sdp string) string {
+	family := ""
+	for _, line := range strings.Split(sdp, "\r\n") {
+		key, _, ok := parseCandidate(line)
+		if !ok {
+			continue
+		}
+		f := candidateFamily(key)
+		if family != "" && f != family {
+			return ""
+		}
+		family = f
+	}
+	return family
+}
+
+// advertise applies the family s is restricted to to its local sdp, and
+// records the family of the candidates left.
+func (s *session) advertise(sdp string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wantFamily != "" {
+		sdp = keepFamily(sdp, s.wantFamily)
+	}
+	s.family, s.advertised = sdpFamily(sdp), true
+	return sdp
+}
+
+// selectedFamily returns the family of the pair ICE selects, known when
+// s advertised candidates of one family only: pairs never mix families.
+func (s *session) selectedFamily() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.family
+}
+
+// waitICE reports false when ICE of s did not connect within d while s
+// was still up.
+func (s *session) waitICE(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-s.iceUp:
+	case <-s.done:
+	case <-t.C:
+		return false
+	}
+	return true
+}
+
+// fallBackIPv4 waits up to -ipv6-timeout for the IPv6 attempt s to
+// connect. When it does not, s is closed without its local connection,
+// which nothing has read from yet, for an IPv4 attempt to take over.
+func (s *session) fallBackIPv4() bool {
+	s.mu.Lock()
+	v6 := !s.advertised || s.family == familyIPv6
+	s.mu.Unlock()
+	if !v6 || s.waitICE(ipv6Timeout) {
+		return false
+	}
+	s.mu.Lock()
+	fallback := s.advertised && s.family == familyIPv6 && !s.open
+	if fallback {
+		s.conn, s.app = nil, nil
+	}
+	s.mu.Unlock()
+	if !fallback {
+		return false
+	}
+	s.logf("session %s: no IPv6 path after %s, falling back to IPv4", s.id, ipv6Timeout)
+	s.fail(errNoIPv6)
+	return true
+}
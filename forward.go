@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// defaultQueueTimeout bounds how long a queued connection waits for a slot.
+const defaultQueueTimeout = 30 * time.Second
+
+// forward is a local listener tunneled to a destination on the server side.
+// An empty remote means the server's -dial address. An eager forward keeps
+// a tunnel established ahead of the next connection.
+type forward struct {
+	listen string
+	remote string
+	// name tags the forward's sessions in logs, status and metrics.
+	name string
+	// app is the app= hint of its sessions' failure messages.
+	app   string
+	eager bool
+	// maxConn caps simultaneous connections (0 = unlimited); up to queue
+	// more wait for a slot for at most queueTimeout.
+	maxConn      int
+	queue        int
+	queueTimeout time.Duration
+
+	mu     sync.Mutex
+	l      net.Listener
+	conns  map[net.Conn]bool
+	warm   *warmConn
+	closed bool
+	slots  chan struct{}
+	queued int
+}
+
+// parseForward parses a forward spec in ssh -L style:
+// "port:hostport", "port:host:hostport" or "bind:port:host:hostport", or
+// "port:route" for a route named on the server.
+// A missing host selects the host of the server's -dial address. Ports may
+// be ranges ("8000-8010:9000-9010") of equal size, mapped one to one.
+// Trailing options "maxconn=N", "queue=N" and "queue-timeout=D" limit
+// each forward's connections, e.g. "3306:3306:maxconn=10:queue=20", and
+// "name=NAME" tags its sessions (a route names them by default) and
+// "app=git" or "app=ssh" overrides -app-hint.
+func parseForward(spec string) ([]*forward, error) {
+	p := strings.Split(spec, ":")
+	var opts []string
+	for len(p) > 0 && strings.Contains(p[len(p)-1], "=") {
+		opts = append(opts, p[len(p)-1])
+		p = p[:len(p)-1]
+	}
+	fs, err := parseForwardAddrs(spec, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		i := strings.Index(opt, "=")
+		name, value := opt[:i], opt[i+1:]
+		for _, f := range fs {
+			if err := f.setOption(name, value); err != nil {
+				return nil, fmt.Errorf("invalid forward %q: %v", spec, err)
+			}
+		}
+	}
+	return fs, nil
+}
+
+func (f *forward) setOption(name, value string) error {
+	var err error
+	switch name {
+	case "maxconn":
+		f.maxConn, err = strconv.Atoi(value)
+		if err == nil && f.maxConn < 1 {
+			err = fmt.Errorf("maxconn must be at least 1")
+		}
+	case "queue":
+		f.queue, err = strconv.Atoi(value)
+		if err == nil && f.queue < 0 {
+			err = fmt.Errorf("queue must not be negative")
+		}
+	case "queue-timeout":
+		f.queueTimeout, err = time.ParseDuration(value)
+	case "name":
+		f.name = value
+		if !validForwardName(value) {
+			err = fmt.Errorf("name must be a letter followed by up to %d of A-Z a-z 0-9 _ -", maxForwardName-1)
+		}
+	case "app":
+		f.app = value
+		if !appHints[value] {
+			err = appHintError(value)
+		}
+	default:
+		err = fmt.Errorf("unknown option %q", name)
+	}
+	return err
+}
+
+func parseForwardAddrs(spec string, p []string) ([]*forward, error) {
+	var bind, lport, host, rport string
+	switch len(p) {
+	case 2:
+		lport, rport = p[0], p[1]
+	case 3:
+		lport, host, rport = p[0], p[1], p[2]
+	case 4:
+		bind, lport, host, rport = p[0], p[1], p[2], p[3]
+	default:
+		return nil, fmt.Errorf("invalid forward: %q", spec)
+	}
+	llo, lhi, err := portRange(lport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forward %q: %v", spec, err)
+	}
+	if len(p) == 2 && routeName.MatchString(rport) {
+		if err := validRoute(rport); err != nil {
+			return nil, fmt.Errorf("invalid forward %q: %v", spec, err)
+		}
+		if lhi != llo {
+			return nil, fmt.Errorf("invalid forward %q: a route takes a single port", spec)
+		}
+		return []*forward{{listen: listenAddr(lport), remote: rport, name: rport}}, nil
+	}
+	rlo, rhi, err := portRange(rport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forward %q: %v", spec, err)
+	}
+	if lhi-llo != rhi-rlo {
+		return nil, fmt.Errorf("invalid forward %q: port ranges differ in size", spec)
+	}
+	var fs []*forward
+	for i := 0; i <= lhi-llo; i++ {
+		f := &forward{
+			listen: strconv.Itoa(llo + i),
+			remote: net.JoinHostPort(host, strconv.Itoa(rlo+i)),
+		}
+		if bind != "" {
+			f.listen = net.JoinHostPort(bind, f.listen)
+		}
+		f.listen = listenAddr(f.listen)
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+// portRange parses "port" or "first-last".
+func portRange(s string) (int, int, error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	l, err := strconv.Atoi(lo)
+	if err != nil || l < 1 || l > 65535 {
+		return 0, 0, fmt.Errorf("bad port %q", lo)
+	}
+	h, err := strconv.Atoi(hi)
+	if err != nil || h < l || h > 65535 {
+		return 0, 0, fmt.Errorf("bad port %q", hi)
+	}
+	return l, h, nil
+}
+
+// listenAddr completes a bare port with the loopback address. localhost
+// rather than 127.0.0.1 keeps this working on IPv6 only hosts.
+func listenAddr(s string) string {
+	if strings.Contains(s, ":") {
+		return s
+	}
+	return net.JoinHostPort("localhost", s)
+}
+
+// listenFallback makes a forward whose port is taken listen on the next
+// free one of up to listenFallbackPorts following ports.
+var listenFallback bool
+
+const listenFallbackPorts = 100
+
+// bind listens on f.listen, telling "address in use" apart from other
+// errors and, with -listen-fallback, moving f to the next free port.
+func (f *forward) bind() (net.Listener, error) {
+	l, err := listen(f.listen)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
+	host, port, _ := net.SplitHostPort(f.listen)
+	if !listenFallback {
+		return nil, fmt.Errorf("listen %s: port %s is already in use, is another ssh-p2p client running? (-listen-fallback picks the next free port)", f.listen, port)
+	}
+	p, _ := strconv.Atoi(port)
+	for i := p + 1; i <= p+listenFallbackPorts && i <= 65535; i++ {
+		addr := net.JoinHostPort(host, strconv.Itoa(i))
+		if l, err := listen(addr); err == nil {
+			log.Printf("listen %s: port %s is in use, using %s instead", f.listen, port, addr)
+			f.listen = addr
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("listen %s: port %s and the next %d are in use", f.listen, port, listenFallbackPorts)
+}
+
+func (f *forward) start(ctx context.Context, key string) error {
+	l, err := f.bind()
+	if err != nil {
+		return err
+	}
+	f.l = l
+	f.conns = map[net.Conn]bool{}
+	if f.maxConn > 0 {
+		f.slots = make(chan struct{}, f.maxConn)
+	}
+	remote := f.remote
+	if remote == "" {
+		remote = "server -dial"
+	}
+	log.Println("listen:", f.listen, "->", remote)
+	if f.eager {
+		go f.prewarm(ctx, key)
+	}
+	go func() {
+		for {
+			sock, err := l.Accept()
+			if err != nil {
+				f.mu.Lock()
+				closed := f.closed
+				f.mu.Unlock()
+				if closed {
+					return
+				}
+				log.Println(err)
+				continue
+			}
+			if !allowSources.allows(sock.RemoteAddr()) {
+				log.Printf("forward %s: refusing %s, not in -allow-source", f.listen, sock.RemoteAddr())
+				sock.Close()
+				continue
+			}
+			tuneTCP(sock)
+			go func() {
+				conn, err := acceptProxy(sock)
+				if err != nil {
+					log.Printf("forward %s: refusing %s: %v", f.listen, sock.RemoteAddr(), err)
+					sock.Close()
+					return
+				}
+				if pause.refusing() {
+					log.Printf("forward %s: paused, refusing %s", f.listen, conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+				c, ok := f.track(conn)
+				if !ok {
+					log.Printf("forward %s: removed, closing %s", f.listen, conn.RemoteAddr())
+					conn.Close()
+					return
+				}
+				if !f.acquire(c) {
+					c.Close()
+					return
+				}
+				if f.takeWarm(c) {
+					return
+				}
+				f.tunnel(ctx, key, c)
+			}()
+		}
+	}()
+	return nil
+}
+
+// track registers conn as an active connection of f. It reports false
+// when f was closed since conn was accepted, as by a remove while its
+// PROXY protocol header was still being read.
+func (f *forward) track(conn net.Conn) (*trackedConn, bool) {
+	c := &trackedConn{Conn: conn, f: f}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, false
+	}
+	f.conns[c] = true
+	return c, true
+}
+
+// tunnel connects c to the forward's remote, failing the session when its
+// data channel is not open within -handshake-timeout: an offer taken by a
+// server that went down is never answered.
+func (f *forward) tunnel(ctx context.Context, key string, c net.Conn) {
+	app := f.app
+	if app == "" {
+		app = appHint
+	}
+	token, failed, ok := startAttempt()
+	if !ok {
+		log.Printf("forward %s: peer unreachable (%d failed attempts), refusing %s while the next attempt is in progress", f.listen, failed, c.RemoteAddr())
+		c.Close()
+		return
+	}
+	s, err := connect(ctx, key, f.remote, f.name, app, c)
+	if err != nil {
+		endAttempt(token, err)
+		return
+	}
+	err = s.wait(handshakeTimeout)
+	if err != nil {
+		s.logf("session %s: %v", s.id, err)
+	}
+	endAttempt(token, err)
+}
+
+// acquire takes a connection slot for c under maxconn, queueing when all
+// are taken. It reports false, having logged why, when c must be closed.
+func (f *forward) acquire(c *trackedConn) bool {
+	if f.slots == nil {
+		return true
+	}
+	select {
+	case f.slots <- struct{}{}:
+		return f.hold(c)
+	default:
+	}
+	f.mu.Lock()
+	if f.queued >= f.queue {
+		f.mu.Unlock()
+		log.Printf("forward %s: %d connections active, rejecting %s", f.listen, f.maxConn, c.RemoteAddr())
+		return false
+	}
+	f.queued++
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.queued--
+		f.mu.Unlock()
+	}()
+	timeout := f.queueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case f.slots <- struct{}{}:
+		return f.hold(c)
+	case <-t.C:
+		log.Printf("forward %s: queued %s for %s without a free connection, closing", f.listen, c.RemoteAddr(), timeout)
+		return false
+	}
+}
+
+// hold records the slot just taken for c, giving it back when c was
+// closed meanwhile.
+func (f *forward) hold(c *trackedConn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.conns[c] {
+		<-f.slots
+		return false
+	}
+	c.slot = true
+	return true
+}
+
+// counts returns the active and queued connections of f.
+func (f *forward) counts() (active, queued int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns) - f.queued, f.queued
+}
+
+// Close stops listening and closes the forward's active connections.
+func (f *forward) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	conns := f.conns
+	f.conns = nil
+	warm := f.warm
+	f.warm = nil
+	f.mu.Unlock()
+	for c := range conns {
+		c.Close()
+	}
+	if warm != nil {
+		warm.Close()
+	}
+	return f.l.Close()
+}
+
+type trackedConn struct {
+	net.Conn
+	f    *forward
+	slot bool
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.f.mu.Lock()
+		delete(c.f.conns, c)
+		slot := c.slot
+		c.f.mu.Unlock()
+		if slot {
+			<-c.f.slots
+		}
+	})
+	return c.Conn.Close()
+}
+
+// forwarder manages the client's set of forwards.
+type forwarder struct {
+	ctx context.Context
+	key string
+
+	mu sync.Mutex
+	m  map[string]*forward
+}
+
+// add starts all of fs, or none of them when one overlaps an existing
+// forward or fails to listen.
+func (fw *forwarder) add(fs ...*forward) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	seen := map[string]bool{}
+	for _, f := range fs {
+		if _, ok := fw.m[f.listen]; ok || seen[f.listen] {
+			return fmt.Errorf("already forwarding: %s", f.listen)
+		}
+		seen[f.listen] = true
+	}
+	for i, f := range fs {
+		if err := f.start(fw.ctx, fw.key); err != nil {
+			for _, v := range fs[:i] {
+				v.Close()
+			}
+			return err
+		}
+	}
+	for _, f := range fs {
+		fw.m[f.listen] = f
+	}
+	return nil
+}
+
+func (fw *forwarder) remove(listen string) error {
+	listen = listenAddr(listen)
+	fw.mu.Lock()
+	f, ok := fw.m[listen]
+	delete(fw.m, listen)
+	fw.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such forward: %s", listen)
+	}
+	log.Println("remove:", listen)
+	return f.Close()
+}
+
+// closeAll stops all forwards.
+func (fw *forwarder) closeAll() {
+	fw.mu.Lock()
+	m := fw.m
+	fw.m = map[string]*forward{}
+	fw.mu.Unlock()
+	for _, f := range m {
+		f.Close()
+	}
+}
+
+// status lists the forwards as listen address -> remote.
+func (fw *forwarder) status() interface{} {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	m := map[string]string{}
+	for listen, f := range fw.m {
+		m[listen] = f.remote
+	}
+	return m
+}
+
+// conns reports each forward's active and queued connections.
+func (fw *forwarder) conns() interface{} {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	m := map[string]map[string]int{}
+	for listen, f := range fw.m {
+		active, queued := f.counts()
+		m[listen] = map[string]int{"active": active, "queued": queued}
+	}
+	return m
+}
+
+// commands reads "add SPEC" and "remove [bind:]port" lines from r.
+func (fw *forwarder) commands(r io.Reader) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		args := strings.Fields(s.Text())
+		if len(args) == 0 {
+			continue
+		}
+		var err error
+		switch {
+		case args[0] == "add" && len(args) == 2:
+			var fs []*forward
+			if fs, err = parseForward(args[1]); err == nil {
+				err = fw.add(fs...)
+			}
+		case args[0] == "remove" && len(args) == 2:
+			err = fw.remove(args[1])
+		default:
+			err = fmt.Errorf("unknown command: %q", s.Text())
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func withAcceptProxyProtocol(t *testing.T) {
+	t.Helper()
+	old := acceptProxyProtocol
+	acceptProxyProtocol = true
+	t.Cleanup(func() { acceptProxyProtocol = old })
+}
+
+// TestRemoveWhileReadingProxyHeader accepts a connection whose PROXY
+// protocol header arrives only after its forward was removed.
+func TestRemoveWhileReadingProxyHeader(t *testing.T) {
+	withAcceptProxyProtocol(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fw := &forwarder{ctx: ctx, m: map[string]*forward{}}
+	f := &forward{listen: "127.0.0.1:0"}
+	if err := fw.add(f); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", f.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := fw.remove(f.listen); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 40000 22\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection of a removed forward: got %v, want EOF", err)
+	}
+	if active, _ := f.counts(); active != 0 {
+		t.Fatalf("removed forward tracks %d connections", active)
+	}
+}
@@ -3,7 +3,9 @@ module github.com/nobonobo/ssh-p2p
 require (
 	github.com/google/go-cmp v0.2.0 // indirect
 	github.com/google/uuid v1.0.0
+	github.com/pions/pkg v0.0.0-20181115215726-b60cd756f712
 	github.com/pions/transport v0.1.0 // indirect
 	github.com/pions/webrtc v1.2.0
+	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
 	gotest.tools v2.2.0+incompatible // indirect
 )
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// maxHandshakes is -max-concurrent-handshakes: how many sessions the
+	// server sets up at a time, from taking the offer to the data channel
+	// open (0 = unlimited).
+	maxHandshakes int
+	// handshakeQueueTimeout is how long an offer waits for a handshake
+	// slot before it is refused.
+	handshakeQueueTimeout = 10 * time.Second
+)
+
+// handshakes holds one slot per session in setup. While all are taken the
+// server pulls no more offers, which leaves them to other servers sharing
+// the key or queued in signaling.
+var handshakes struct {
+	slots  chan struct{}
+	queued int64
+}
+
+var errHandshakeQueue = fmt.Errorf("%w: no handshake slot free (-max-concurrent-handshakes)", errTimeout)
+
+// handshakeStatus is the handshakes metric.
+type handshakeStatus struct {
+	InProgress int   `json:"in_progress"`
+	Queued     int64 `json:"queued"`
+	Max        int   `json:"max"`
+}
+
+func setupHandshakes() {
+	if maxHandshakes < 0 {
+		fatalConfig("-max-concurrent-handshakes must not be negative")
+	}
+	if maxHandshakes == 0 {
+		return
+	}
+	handshakes.slots = make(chan struct{}, maxHandshakes)
+	status := func() interface{} {
+		return handshakeStatus{InProgress: len(handshakes.slots), Queued: atomic.LoadInt64(&handshakes.queued), Max: maxHandshakes}
+	}
+	statusFuncs["handshakes"] = status
+	expvar.Publish("handshakes", expvar.Func(status))
+}
+
+// acquireHandshake takes a handshake slot, waiting up to
+// -handshake-queue-timeout for one.
+func acquireHandshake() error {
+	if handshakes.slots == nil {
+		return nil
+	}
+	select {
+	case handshakes.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	atomic.AddInt64(&handshakes.queued, 1)
+	defer atomic.AddInt64(&handshakes.queued, -1)
+	t := time.NewTimer(handshakeQueueTimeout)
+	defer t.Stop()
+	select {
+	case handshakes.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		return errHandshakeQueue
+	}
+}
+
+// holdHandshake hands the slot just taken to s, which gives it back once
+// its data channel opened or it closed. A session not open within
+// -handshake-timeout is closed, so a stuck handshake cannot keep its slot.
+func (s *session) holdHandshake() {
+	if handshakes.slots == nil {
+		return
+	}
+	s.mu.Lock()
+	over := s.open || s.closed
+	s.handshake = !over
+	s.mu.Unlock()
+	if over {
+		freeHandshake()
+		return
+	}
+	go s.wait(handshakeTimeout)
+}
+
+// releaseHandshake gives back the handshake slot of s, if it holds one.
+func (s *session) releaseHandshake() {
+	s.mu.Lock()
+	held := s.handshake
+	s.handshake = false
+	s.mu.Unlock()
+	if held {
+		freeHandshake()
+	}
+}
+
+// freeHandshake gives back a slot taken by acquireHandshake.
+func freeHandshake() {
+	if handshakes.slots != nil {
+		<-handshakes.slots
+	}
+}
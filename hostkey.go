@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshHostKeys pins the SSH host key fingerprints (SHA256:...) the server's
+// -dial target may present. sshHostKeyWarn only logs a mismatch.
+var (
+	sshHostKeys    stringsFlag
+	sshHostKeyWarn bool
+)
+
+// SSH message numbers that may carry the server host key: KEXDH_REPLY and
+// KEX_ECDH_REPLY are 31, KEX_DH_GEX_REPLY is 33 (where 31 is the group).
+const (
+	sshMsgNewKeys  = 21
+	sshMsgKexReply = 31
+	sshMsgGexReply = 33
+	// maxSSHPreamble bounds what may precede the identification line.
+	maxSSHPreamble = 8 << 10
+	maxSSHPacket   = 256 << 10
+)
+
+var errNotSSH = errors.New("not an SSH connection")
+
+// hostKeyCheck follows the server to client half of an SSH connection in
+// the clear, up to the host key in the key exchange reply, and checks
+// that key against -ssh-hostkey.
+type hostKeyCheck struct {
+	buf     []byte
+	version bool
+	done    bool
+	err     error
+	failed  bool
+}
+
+// feed inspects b, the next bytes from the server. It fails when the host
+// key is not pinned, before b (which completes the reply) is passed on,
+// and keeps failing for all bytes after.
+func (c *hostKeyCheck) feed(b []byte) error {
+	if c.done {
+		return c.err
+	}
+	c.buf = append(c.buf, b...)
+	c.err = c.parse()
+	if c.err != nil || c.done {
+		c.done, c.buf = true, nil
+	}
+	return c.err
+}
+
+func (c *hostKeyCheck) parse() error {
+	for !c.version {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			if len(c.buf) > maxSSHPreamble {
+				return errNotSSH
+			}
+			return nil
+		}
+		c.version = bytes.HasPrefix(c.buf, []byte("SSH-"))
+		c.buf = c.buf[i+1:]
+	}
+	for len(c.buf) >= 5 {
+		n := int(binary.BigEndian.Uint32(c.buf))
+		pad := int(c.buf[4])
+		if n > maxSSHPacket || pad+1 > n {
+			return fmt.Errorf("%w: malformed packet", errNotSSH)
+		}
+		if len(c.buf) < 4+n {
+			return nil
+		}
+		payload := c.buf[5 : 4+n-pad]
+		c.buf = c.buf[4+n:]
+		if len(payload) == 0 {
+			continue
+		}
+		switch payload[0] {
+		case sshMsgNewKeys:
+			return fmt.Errorf("%w: no host key before NEWKEYS", errNotSSH)
+		case sshMsgKexReply, sshMsgGexReply:
+			if key, ok := parseHostKeyBlob(payload[1:]); ok {
+				c.done = true
+				return verifyHostKey(key)
+			}
+		}
+	}
+	return nil
+}
+
+// parseHostKeyBlob parses the leading string of a reply as a public key.
+func parseHostKeyBlob(b []byte) (ssh.PublicKey, bool) {
+	if len(b) < 4 {
+		return nil, false
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		return nil, false
+	}
+	key, err := ssh.ParsePublicKey(b[4 : 4+n])
+	return key, err == nil
+}
+
+func verifyHostKey(key ssh.PublicKey) error {
+	fp := ssh.FingerprintSHA256(key)
+	for _, pin := range sshHostKeys {
+		if pin == fp {
+			log.Println("ssh host key pinned:", fp)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: ssh host key %s %s is not pinned by -ssh-hostkey", errAuthRejected, key.Type(), fp)
+}
+
+// checkHostKey applies -ssh-hostkey to data from the server, reporting
+// false when s was closed for a host key mismatch.
+func (s *session) checkHostKey(data []byte) bool {
+	if s.hostKey == nil {
+		return true
+	}
+	err := s.hostKey.feed(data)
+	if err == nil {
+		return true
+	}
+	if sshHostKeyWarn {
+		s.logf("WARNING: POSSIBLE MAN-IN-THE-MIDDLE: %v", err)
+		s.hostKey = nil
+		return true
+	}
+	if !s.hostKey.failed {
+		s.hostKey.failed = true
+		s.logf("closing session: %v", err)
+		go s.fail(err)
+	}
+	return false
+}
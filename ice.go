@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pions/webrtc"
+)
+
+// iceDiscovery fetches the ICE server list from -ice-discovery-url. The
+// endpoint answers
+//
+//	{"iceServers": [{"urls": ["turn:..."], "username": "...", "credential": "..."}], "ttl": 3600}
+//
+// and the result is cached for ttl seconds, refreshed once 80% of it passed.
+type iceDiscovery struct {
+	url string
+
+	mu      sync.Mutex
+	servers []webrtc.RTCIceServer
+	refresh time.Time
+	expires time.Time
+}
+
+var discovery *iceDiscovery
+
+type iceServerJSON struct {
+	URLs       json.RawMessage `json:"urls"`
+	Username   string          `json:"username"`
+	Credential string          `json:"credential"`
+}
+
+// rtcConfiguration returns the configuration for a new PeerConnection,
+// falling back to the static servers when discovery fails.
+func rtcConfiguration() webrtc.RTCConfiguration {
+	if discovery == nil {
+		return defaultRTCConfiguration
+	}
+	servers, err := discovery.get()
+	if err != nil {
+		log.Println("ice discovery failed, using static servers:", err)
+		return defaultRTCConfiguration
+	}
+	return webrtc.RTCConfiguration{IceServers: servers}
+}
+
+func (d *iceDiscovery) get() ([]webrtc.RTCIceServer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if now.Before(d.refresh) {
+		return d.servers, nil
+	}
+	servers, ttl, err := d.fetch()
+	if err != nil {
+		if now.Before(d.expires) {
+			log.Println("ice discovery refresh failed:", err)
+			return d.servers, nil
+		}
+		return nil, err
+	}
+	d.servers = servers
+	d.refresh = now.Add(ttl * 8 / 10)
+	d.expires = now.Add(ttl)
+	log.Printf("ice discovery: %d servers, ttl %s", len(servers), ttl)
+	return servers, nil
+}
+
+func (d *iceDiscovery) fetch() ([]webrtc.RTCIceServer, time.Duration, error) {
+	resp, err := http.Get(d.url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("http failed: %s", resp.Status)
+	}
+	var v struct {
+		IceServers []iceServerJSON `json:"iceServers"`
+		TTL        int             `json:"ttl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, 0, err
+	}
+	var servers []webrtc.RTCIceServer
+	for _, s := range v.IceServers {
+		var urls []string
+		if err := json.Unmarshal(s.URLs, &urls); err != nil {
+			var url string
+			if err := json.Unmarshal(s.URLs, &url); err != nil {
+				return nil, 0, fmt.Errorf("bad urls: %s", s.URLs)
+			}
+			urls = []string{url}
+		}
+		server := webrtc.RTCIceServer{URLs: urls}
+		if s.Username != "" || s.Credential != "" {
+			server.Username = s.Username
+			server.Credential = s.Credential
+			server.CredentialType = webrtc.RTCIceCredentialTypePassword
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("no ice servers")
+	}
+	ttl := time.Duration(v.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	return servers, ttl, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nobonobo/ssh-p2p/signaling"
+)
+
+var (
+	// identity signs our SDPs when set (-identity).
+	identity ed25519.PrivateKey
+	// instance identifies this run of identity.
+	instance = uuid.New().String()
+)
+
+// loadIdentity reads an ed25519 key from path, generating it first when the
+// file does not exist.
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			return nil, err
+		}
+		log.Println("identity generated:", path)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return key, nil
+}
+
+// fingerprint formats a public key the way ssh-keygen -l does.
+func fingerprint(pub []byte) string {
+	h := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// signedVersion is the first schema version whose signature covers every
+// field but the public key and the signature.
+const signedVersion = 3
+
+// signedData is what the signature of info covers: every field a relay
+// could otherwise swap under a valid signature, each length prefixed so
+// that no two messages encode the same.
+func signedData(info signaling.ConnectInfo) []byte {
+	var b bytes.Buffer
+	b.WriteString("ssh-p2p signature\x00")
+	at := strconv.FormatInt(info.Time, 10)
+	keepalive := strconv.FormatInt(info.Keepalive, 10)
+	for _, f := range []string{info.SDP, info.Instance, info.Source, info.Origin, info.Label, info.Nonce, at,
+		info.Name, info.AEAD, string(info.Salt), info.Banner, info.Trace, keepalive} {
+		binary.Write(&b, binary.BigEndian, uint32(len(f)))
+		b.WriteString(f)
+	}
+	return b.Bytes()
+}
+
+// sign attaches our identity to info, once its other fields are final.
+func sign(info *signaling.ConnectInfo) {
+	if identity == nil {
+		return
+	}
+	info.Instance = instance
+	info.Nonce = hex.EncodeToString(nonce())
+	info.Time = time.Now().Unix()
+	info.PublicKey = identity.Public().(ed25519.PublicKey)
+	info.Signature = ed25519.Sign(identity, signedData(*info))
+}
+
+// peerID verifies info's signature and returns the sender's fingerprint.
+func peerID(info signaling.ConnectInfo) (string, error) {
+	if len(info.PublicKey) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("%w: peer %s is anonymous", errAuthRejected, info.Source)
+	}
+	if info.Version < signedVersion {
+		return "", fmt.Errorf("%w: peer %s signs with schema version %d, upgrade it to %d", errAuthRejected, info.Source, info.Version, signedVersion)
+	}
+	if !ed25519.Verify(info.PublicKey, signedData(info), info.Signature) {
+		return "", fmt.Errorf("%w: peer %s: bad signature", errAuthRejected, info.Source)
+	}
+	return fingerprint(info.PublicKey), nil
+}
+
+// peerList is the server's -allow-peer set, reloadable from a file.
+type peerList struct {
+	flags stringsFlag
+	file  string
+
+	mu sync.RWMutex
+	m  map[string]bool
+}
+
+func (l *peerList) load() error {
+	m := map[string]bool{}
+	for _, v := range l.flags {
+		m[v] = true
+	}
+	if l.file != "" {
+		b, err := ioutil.ReadFile(l.file)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				m[line] = true
+			}
+		}
+	}
+	l.mu.Lock()
+	l.m = m
+	l.mu.Unlock()
+	log.Println("allowed peers:", len(m))
+	return nil
+}
+
+// check returns nil when the peer may connect. An empty list allows any
+// peer, but a signed message must still verify and be fresh: its Instance
+// decides which sessions claim reclaims.
+func (l *peerList) check(info signaling.ConnectInfo) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.m) == 0 {
+		if len(info.PublicKey) == 0 && len(info.Signature) == 0 {
+			return nil
+		}
+		if _, err := peerID(info); err != nil {
+			return err
+		}
+		return seenNonces.fresh(info)
+	}
+	id, err := peerID(info)
+	if err != nil {
+		return err
+	}
+	if err := seenNonces.fresh(info); err != nil {
+		return err
+	}
+	if !l.m[id] {
+		return fmt.Errorf("%w: peer %s not allowed: %s", errAuthRejected, info.Source, id)
+	}
+	return nil
+}
+
+// signedWindow is how far the Time of a signed message may be off from
+// ours. Nonces are remembered this long, so a message is taken once.
+const signedWindow = 5 * time.Minute
+
+// seenNonces holds the nonces of the signed messages taken lately.
+var seenNonces = &nonceCache{m: map[string]time.Time{}}
+
+type nonceCache struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+// fresh reports a verified message that is too old, from too far in the
+// future, or replayed.
+func (c *nonceCache) fresh(info signaling.ConnectInfo) error {
+	now := time.Now()
+	at := time.Unix(info.Time, 0)
+	if info.Nonce == "" || at.Before(now.Add(-signedWindow)) || at.After(now.Add(signedWindow)) {
+		return fmt.Errorf("%w: peer %s: stale message (sent %s, clocks may differ by at most %s)", errAuthRejected, info.Source, at.Format(time.RFC3339), signedWindow)
+	}
+	key := string(info.PublicKey) + info.Nonce
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, t := range c.m {
+		if now.Sub(t) > 2*signedWindow {
+			delete(c.m, k)
+		}
+	}
+	if _, ok := c.m[key]; ok {
+		return fmt.Errorf("%w: peer %s: replayed message", errAuthRejected, info.Source)
+	}
+	c.m[key] = now
+	return nil
+}
+
+func nonce() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}
+
+// checkAnswer vets the answer v to an offer the server made on request:
+// it must pass -allow-peer as the request did, and come from the same
+// identity.
+func (s *session) checkAnswer(v signaling.ConnectInfo) error {
+	if err := allowPeers.check(v); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	peer := s.peer
+	s.mu.Unlock()
+	if peer == "" {
+		return nil
+	}
+	id, err := peerID(v)
+	if err != nil {
+		return err
+	}
+	if id != peer {
+		return fmt.Errorf("%w: answer for session %s from %s, not the requesting peer %s", errAuthRejected, s.id, id, peer)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nobonobo/ssh-p2p/signaling"
+)
+
+func withIdentity(t *testing.T) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := identity
+	identity = key
+	t.Cleanup(func() { identity = old })
+}
+
+func TestSignedFieldsTampered(t *testing.T) {
+	withIdentity(t)
+	info := signaling.ConnectInfo{
+		Version: signaling.Version, Source: "a", SDP: "v=0", Origin: "192.0.2.1:22",
+		Name: "laptop", AEAD: aeadName, Salt: []byte{0}, Banner: "notice",
+		Trace: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", Keepalive: 15000,
+	}
+	sign(&info)
+	if _, err := peerID(info); err != nil {
+		t.Fatal(err)
+	}
+	for name, tamper := range map[string]func(*signaling.ConnectInfo){
+		"sdp":       func(v *signaling.ConnectInfo) { v.SDP = "v=1" },
+		"instance":  func(v *signaling.ConnectInfo) { v.Instance = "other" },
+		"source":    func(v *signaling.ConnectInfo) { v.Source = "b" },
+		"origin":    func(v *signaling.ConnectInfo) { v.Origin = "" },
+		"label":     func(v *signaling.ConnectInfo) { v.Label = "other:22" },
+		"nonce":     func(v *signaling.ConnectInfo) { v.Nonce = "00" },
+		"time":      func(v *signaling.ConnectInfo) { v.Time++ },
+		"name":      func(v *signaling.ConnectInfo) { v.Name = "other" },
+		"aead":      func(v *signaling.ConnectInfo) { v.AEAD = "" },
+		"salt":      func(v *signaling.ConnectInfo) { v.Salt = []byte{1} },
+		"banner":    func(v *signaling.ConnectInfo) { v.Banner = "other" },
+		"trace":     func(v *signaling.ConnectInfo) { v.Trace = "" },
+		"keepalive": func(v *signaling.ConnectInfo) { v.Keepalive = 0 },
+		// a field boundary moved: "a"+"v=0" must not verify as ""+"av=0"
+		"boundary": func(v *signaling.ConnectInfo) { v.Source, v.SDP = "", "a"+v.SDP },
+	} {
+		v := info
+		tamper(&v)
+		if _, err := peerID(v); !errors.Is(err, errAuthRejected) {
+			t.Errorf("%s tampered: got %v, want auth rejected", name, err)
+		}
+	}
+}
+
+// TestSignedDataGolden pins the bytes a signature covers, as the README
+// wire protocol section describes them for peers in other languages, and
+// the signature of a fixed key over them.
+func TestSignedDataGolden(t *testing.T) {
+	info := signaling.ConnectInfo{
+		Version:   signaling.Version,
+		Source:    "a",
+		SDP:       "v=0",
+		Instance:  "run",
+		Nonce:     "00ff",
+		Time:      1700000000,
+		Label:     "db",
+		Name:      "laptop",
+		AEAD:      "aes-256-gcm",
+		Salt:      []byte{0xde, 0xad},
+		Origin:    "192.0.2.1:22",
+		Banner:    "hi",
+		Trace:     "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		Keepalive: 15000,
+	}
+	want := "ssh-p2p signature\x00" +
+		"\x00\x00\x00\x03v=0" +
+		"\x00\x00\x00\x03run" +
+		"\x00\x00\x00\x01a" +
+		"\x00\x00\x00\x0c192.0.2.1:22" +
+		"\x00\x00\x00\x02db" +
+		"\x00\x00\x00\x0400ff" +
+		"\x00\x00\x00\x0a1700000000" +
+		"\x00\x00\x00\x06laptop" +
+		"\x00\x00\x00\x0baes-256-gcm" +
+		"\x00\x00\x00\x02\xde\xad" +
+		"\x00\x00\x00\x02hi" +
+		"\x00\x00\x00\x3700-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01" +
+		"\x00\x00\x00\x0515000"
+	got := signedData(info)
+	if string(got) != want {
+		t.Fatalf("signed data\n%q\nwant\n%q", got, want)
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	const sig = "6b16669ecf9386f4eb19c2436cf2029add7cf0d134a26451683bb37ca417761d9b7a76c093cf419eeea0b72216efd52036cf04196b1191e33c022bf7348ba702"
+	if got := hex.EncodeToString(ed25519.Sign(key, got)); got != sig {
+		t.Fatalf("signature %s, want %s", got, sig)
+	}
+	// absent fields are empty, absent numbers 0
+	want = "ssh-p2p signature\x00" + strings.Repeat("\x00\x00\x00\x00", 6) + "\x00\x00\x00\x010" +
+		strings.Repeat("\x00\x00\x00\x00", 5) + "\x00\x00\x00\x010"
+	if got := signedData(signaling.ConnectInfo{}); string(got) != want {
+		t.Fatalf("signed data of an empty message\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestSignedOldVersionRefused(t *testing.T) {
+	withIdentity(t)
+	info := signaling.ConnectInfo{Version: signedVersion - 1, Source: "a", SDP: "v=0"}
+	sign(&info)
+	if _, err := peerID(info); !errors.Is(err, errAuthRejected) {
+		t.Fatalf("got %v, want auth rejected", err)
+	}
+}
+
+func TestCheckVerifiesWithoutAllowList(t *testing.T) {
+	withIdentity(t)
+	var l peerList
+	if err := l.check(signaling.ConnectInfo{Source: "anon", SDP: "v=0"}); err != nil {
+		t.Fatalf("anonymous peer refused: %v", err)
+	}
+	info := signaling.ConnectInfo{Version: signaling.Version, Source: "a", SDP: "v=0"}
+	sign(&info)
+	if err := l.check(info); err != nil {
+		t.Fatalf("signed peer refused: %v", err)
+	}
+	info.Instance = "forged"
+	if err := l.check(info); !errors.Is(err, errAuthRejected) {
+		t.Fatalf("forged instance: got %v, want auth rejected", err)
+	}
+}
+
+func TestRequestReplayRefused(t *testing.T) {
+	withIdentity(t)
+	var l peerList
+	req := signaling.ConnectInfo{Version: signaling.Version, Source: "a", Label: "data"}
+	sign(&req)
+	if err := l.check(req); err != nil {
+		t.Fatalf("fresh request refused: %v", err)
+	}
+	if err := l.check(req); !errors.Is(err, errAuthRejected) {
+		t.Fatalf("replayed request: got %v, want auth rejected", err)
+	}
+}
+
+func TestStaleRequestRefused(t *testing.T) {
+	withIdentity(t)
+	var l peerList
+	for _, at := range []time.Time{time.Now().Add(-2 * signedWindow), time.Now().Add(2 * signedWindow)} {
+		req := signaling.ConnectInfo{Version: signaling.Version, Source: "a", Label: "data"}
+		sign(&req)
+		req.Time = at.Unix()
+		req.Signature = ed25519.Sign(identity, signedData(req))
+		if err := l.check(req); !errors.Is(err, errAuthRejected) {
+			t.Errorf("request sent %s: got %v, want auth rejected", at, err)
+		}
+	}
+}
+
+func TestAnswerFromOtherPeerRefused(t *testing.T) {
+	withIdentity(t)
+	req := signaling.ConnectInfo{Version: signaling.Version, Source: "a", Label: "data"}
+	sign(&req)
+	s := &session{id: "offer"}
+	s.claim(req)
+	answer := signaling.ConnectInfo{Version: signaling.Version, Source: "a", SDP: "v=0"}
+	sign(&answer)
+	if err := s.checkAnswer(answer); err != nil {
+		t.Fatalf("answer of the requesting peer refused: %v", err)
+	}
+	withIdentity(t)
+	other := signaling.ConnectInfo{Version: signaling.Version, Source: "a", SDP: "v=0"}
+	sign(&other)
+	if err := s.checkAnswer(other); !errors.Is(err, errAuthRejected) {
+		t.Fatalf("answer of another peer: got %v, want auth rejected", err)
+	}
+}
@@ -0,0 +1,71 @@
+//go:build ipv6only
+// +build ipv6only
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nobonobo/ssh-p2p/signaling"
+)
+
+// TestIPv6Only tunnels through a forward set up with the default
+// addresses on a host without IPv4. make test-ipv6only runs it in a
+// network namespace that has IPv6 addresses only.
+func TestIPv6Only(t *testing.T) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if ip, _, _ := net.ParseCIDR(a.String()); ip.To4() != nil {
+			t.Fatalf("IPv4 address %s present, run make test-ipv6only", a)
+		}
+	}
+	withSignaling(t, (&signaling.Server{}).Handler())
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	key := room(uuid.New().String())
+	startServer(t, key, net.JoinHostPort("localhost", port))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fw := &forwarder{ctx: ctx, key: key, m: map[string]*forward{}}
+	f := &forward{listen: listenAddr("0")}
+	if err := fw.add(f); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", f.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("read %q, %v through the IPv6 only tunnel", b, err)
+	}
+}
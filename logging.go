@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+var logOutput, logTag string
+
+// logFlags registers the log destination options.
+func logFlags(flags *flag.FlagSet) {
+	flags.StringVar(&logOutput, "log-output", "stderr", "log destination = stderr or syslog (journald reads syslog)")
+	flags.StringVar(&logTag, "log-tag", "ssh-p2p", "program name for syslog")
+}
+
+// setupLog switches the standard logger to -log-output, staying on stderr
+// when the system logger is unreachable.
+func setupLog() {
+	switch logOutput {
+	case "stderr", "":
+	case "syslog":
+		w, err := newSyslog(logTag)
+		if err != nil {
+			log.Println("syslog unavailable, logging to stderr:", err)
+			return
+		}
+		log.SetOutput(w)
+		// syslog stamps the time itself.
+		log.SetFlags(log.Lshortfile)
+	default:
+		fatalConfig("unknown -log-output:", logOutput)
+	}
+}
+
+// Severities of log lines, for destinations that keep them.
+const (
+	severityInfo = iota
+	severityWarning
+	severityErr
+)
+
+// exiting is set by fatal and fatalConfig: the line logged on the way
+// out is an error, whatever it says.
+var exiting int32
+
+// warningWords mark refusals and fallbacks, errorWords failures; a line
+// with neither is informational.
+var (
+	warningWords = []string{"WARNING", ", using", ", keeping", "instead", "refus", "reject", "denied", "unreachable", "unavailable", "timeout", "dropped", "skipped", "dial retry", "budget spent"}
+	errorWords   = []string{"failed", "error"}
+)
+
+// logSeverity picks the severity of a log line from its text.
+func logSeverity(line string) int {
+	if atomic.LoadInt32(&exiting) != 0 {
+		return severityErr
+	}
+	for _, w := range warningWords {
+		if strings.Contains(line, w) {
+			return severityWarning
+		}
+	}
+	for _, w := range errorWords {
+		if strings.Contains(line, w) {
+			return severityErr
+		}
+	}
+	return severityInfo
+}
@@ -3,16 +3,25 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -27,10 +36,41 @@ const usage = `Usage: ssh-p2p SUBCMD [options]
 sub-commands:
 	newkey
 		new generate key of connection
-	server -key="..." [-dial="127.0.0.1:22"]
+	server -key="..." [-dial="localhost:22"] [-allow=host:port ...] [-route=name:host:port ...] [-rewrite=from=to ...] [-resolver=ip:port] [-once] [options]
 		ssh server side peer mode
-	client -key="..." [-listen="127.0.0.1:2222"]
+		with -embedded-ssh, a built-in ssh server (public key auth only)
+		takes the place of -dial
+		SIGHUP reloads -allow-peers and -banner-file
+		with -once, exits when the first session ends (non-zero when
+		its handshake failed)
+		with -signal-self, also serves signaling on -signal-listen
+	client -key="..." [-listen="localhost:2222"] [-forward=[bind:]port[-last]:([host:]hostport[-last]|route) ...] [-stdin] [-eager] [options]
 		ssh client side peer mode
+		with -stdin, "add SPEC" and "remove [bind:]port" lines on stdin
+		add and remove forwards at runtime
+	connect -key="..." -stdio [-remote=...] [options]
+		tunnel stdin and stdout, for ssh -o ProxyCommand="ssh-p2p connect
+		-key=... -stdio"; exits when the session ends
+	ctl [-control-socket=PATH] status|close ID|reconnect|reload|pause [quiesce]|resume
+		send a command to a running server or client
+	probe-ice [-timeout=2s] [-json] [-ice-discovery-url=URL]
+		time a STUN binding request to each ICE server, fastest first
+	export-profile [-include-secrets] SUBCMD [options]
+		print SUBCMD and its options as a shareable profile; secrets
+		become ${SSH_P2P_KEY} / ${SSH_P2P_TOKEN} references
+	import-profile FILE [options]
+		run the profile in FILE, resolving ${VAR} from the environment
+	replay-signaling [-speed=1] [-timeout=10s] [options] FILE
+		run the side that recorded FILE with -record-signaling against
+		the peer messages in it, logging each step, for offline debugging
+	soak -key="..." [-conns=10] [-rate=1] [-duration=30s] [-remote=...] [-json] [options]
+		load test a server: open -conns tunnels at -rate per second to an
+		echo destination and report setup times and throughput
+	signal [-listen=":8080"] [-tls-cert=FILE -tls-key=FILE]
+		minimal signaling server for peers run with -signaling=http://HOST:8080
+	relay [-listen=":9000"] [-token="..."] [-timeout=30s] [-metrics=""]
+		tcp relay pairing two peers by room key
+run "ssh-p2p SUBCMD -h" for the options of a sub-command
 `
 
 var (
@@ -43,28 +83,160 @@ var (
 			},
 		},
 	}
+	dialRetries       = 3
+	dialRetryInterval = 500 * time.Millisecond
+	maxLifetime       time.Duration
+	maxLifetimeGrace  = 30 * time.Second
+	allowTargets      stringsFlag
+	routes            = routeFlag{}
+	rewrites          = rewriteFlag{}
+	resolver          *net.Resolver
+	resolverFallback  bool
+	allowPeers        peerList
+	sshd              *embeddedSSH
+	once              bool
+	signalingURL      = signaling.URI
+	acceptOffers      bool // the server's -answerer: answer client offers
+	askOffer          bool // the client's -answerer: ask the server for the offer
+	maxSDPSize        = int64(signaling.DefaultMaxSDPSize)
+	handshakeTimeout  = 30 * time.Second
+	iceDiscoveryURL   string
+	controlSocket     string
+	plainKey          bool
+	clientName        string
+	// pushWait is how long a push nobody pulls is retried, e.g. while a
+	// standby server comes up.
+	pushWait          = 5 * time.Second
+	pushRetryInterval = 500 * time.Millisecond
+	// client shares cookies across signaling requests so that a load
+	// balancer with cookie based affinity keeps us on one backend.
+	client = newSignalingClient()
 )
 
-func push(dst, src, sdp string) error {
-	buf := bytes.NewBuffer(nil)
-	if err := json.NewEncoder(buf).Encode(signaling.ConnectInfo{
-		Source: src,
-		SDP:    sdp,
-	}); err != nil {
+func newSignalingClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+// roomSalt separates room ids from other uses of the key material.
+const roomSalt = "ssh-p2p room v1:"
+
+// room derives the signaling room id from the key, so the signaling
+// server never learns the key itself. -plain-key keeps the old behaviour
+// for peers that predate hashing.
+func room(key string) string {
+	if plainKey {
+		return key
+	}
+	h := sha256.Sum256([]byte(roomSalt + key))
+	return hex.EncodeToString(h[:])
+}
+
+func push(s *session, dst, src, sdp string) error {
+	info := signaling.ConnectInfo{
+		Version: signaling.Version,
+		Source:  src,
+		SDP:     advertiseMessageSize(limitCandidates(s.advertise(sdp), maxCandidates)),
+		Name:    clientName,
+		Banner:  currentBanner(),
+		Trace:   s.trace.traceparent(),
+	}
+	info.Origin = s.originAddr()
+	info.Keepalive = keepaliveWanted()
+	s.helloAEAD(&info)
+	return post(dst, info)
+}
+
+// request asks dst to send an offer for a data channel labeled label.
+func request(s *session, dst, src, label string) error {
+	info := signaling.ConnectInfo{
+		Version: signaling.Version,
+		Source:  src,
+		Label:   label,
+		Name:    clientName,
+		Trace:   s.trace.traceparent(),
+	}
+	info.Origin = s.originAddr()
+	info.Keepalive = keepaliveWanted()
+	s.helloAEAD(&info)
+	return post(dst, info)
+}
+
+func post(dst string, info signaling.ConnectInfo) error {
+	sign(&info)
+	recorder.record(recordSent, dst, info)
+	if replay != nil {
+		return replay.post(info)
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
 		return err
 	}
-	resp, err := http.Post(signaling.URI+path.Join("/", "push", dst), "application/json", buf)
+	// without sticky sessions the puller may wait on another backend than
+	// the one we hit, so retry until someone picks it up.
+	deadline := time.Now().Add(pushWait)
+	for {
+		resp, err := client.Post(signalingURL+path.Join("/", "push", dst), "application/json", bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("%w: %v", errSignaling, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		if resp.StatusCode != http.StatusNotFound || time.Now().After(deadline) {
+			return fmt.Errorf("%w: http failed: %s", errSignaling, resp.Status)
+		}
+		retries.sleep(pushRetryInterval)
+	}
+}
+
+// checkSchema pushes an empty message of our schema version to an id
+// nobody pulls, which a signaling server of an older schema refuses with
+// 409. Not reaching the server is left to the first real push.
+func checkSchema() error {
+	b, err := json.Marshal(signaling.ConnectInfo{Version: signaling.Version})
 	if err != nil {
 		return err
 	}
+	resp, err := client.Post(signalingURL+path.Join("/", "push", uuid.New().String()), "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Println("schema check skipped:", err)
+		return nil
+	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http failed")
+	if resp.StatusCode != http.StatusConflict {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%w: signaling server refuses schema version %d: %s", errSignaling, signaling.Version, bytes.TrimSpace(msg))
+}
+
+// errDropped marks a pulled message that is skipped, the pull going on.
+var errDropped = errors.New("message dropped")
+
+// decodeInfo reads one pulled message from body, which may be no longer
+// than the signaling server accepts. A message of an incompatible schema
+// version or with an SDP over -max-sdp-size is errDropped.
+func decodeInfo(body io.ReadCloser) (signaling.ConnectInfo, error) {
+	var info signaling.ConnectInfo
+	r := http.MaxBytesReader(nil, body, signaling.MaxBodySize(maxSDPSize))
+	if err := json.NewDecoder(r).Decode(&info); err != nil {
+		return info, err
+	}
+	if !signaling.Compatible(info.Version) {
+		return info, fmt.Errorf("%w: incompatible peer schema version %d", errDropped, info.Version)
+	}
+	if int64(len(info.SDP)) > maxSDPSize {
+		return info, fmt.Errorf("%w: sdp too large: %d bytes (max %d)", errDropped, len(info.SDP), maxSDPSize)
 	}
-	return nil
+	return info, nil
 }
 
 func pull(ctx context.Context, id string) <-chan signaling.ConnectInfo {
+	if replay != nil {
+		return replay.pull(ctx, id)
+	}
 	ch := make(chan signaling.ConnectInfo)
 	var retry time.Duration
 	go func() {
@@ -72,11 +244,11 @@ func pull(ctx context.Context, id string) <-chan signaling.ConnectInfo {
 			if retry < 10 {
 				retry++
 			}
-			time.Sleep(retry * time.Second)
+			retries.sleep(retry * time.Second)
 		}
 		defer close(ch)
 		for {
-			req, err := http.NewRequest("GET", signaling.URI+path.Join("/", "pull", id), nil)
+			req, err := http.NewRequest("GET", signalingURL+path.Join("/", "pull", id), nil)
 			if err != nil {
 				if ctx.Err() == context.Canceled {
 					return
@@ -86,7 +258,7 @@ func pull(ctx context.Context, id string) <-chan signaling.ConnectInfo {
 				continue
 			}
 			req = req.WithContext(ctx)
-			res, err := http.DefaultClient.Do(req)
+			res, err := client.Do(req)
 			if err != nil {
 				if ctx.Err() == context.Canceled {
 					return
@@ -97,8 +269,12 @@ func pull(ctx context.Context, id string) <-chan signaling.ConnectInfo {
 			}
 			defer res.Body.Close()
 			retry = time.Duration(0)
-			var info signaling.ConnectInfo
-			if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+			info, err := decodeInfo(res.Body)
+			if errors.Is(err, errDropped) {
+				log.Println(err)
+				continue
+			}
+			if err != nil {
 				if err == io.EOF {
 					continue
 				}
@@ -109,7 +285,8 @@ func pull(ctx context.Context, id string) <-chan signaling.ConnectInfo {
 				faild()
 				continue
 			}
-			if len(info.Source) > 0 && len(info.SDP) > 0 {
+			if len(info.Source) > 0 && (len(info.SDP) > 0 || len(info.Label) > 0) {
+				recorder.record(recordReceived, id, info)
 				ch <- info
 			}
 		}
@@ -119,6 +296,7 @@ func pull(ctx context.Context, id string) <-chan signaling.ConnectInfo {
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	rand.Seed(time.Now().UnixNano())
 	cmd := ""
 	if len(os.Args) > 1 {
 		cmd = os.Args[1]
@@ -128,7 +306,17 @@ func main() {
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, usage)
 		flags.PrintDefaults()
-		os.Exit(1)
+		os.Exit(exitConfig)
+	}
+
+	switch cmd {
+	case "export-profile":
+		os.Args = append(os.Args[:1], exportProfileArgs(os.Args[2:])...)
+		cmd = os.Args[1]
+	case "import-profile":
+		c, args := importProfileArgs(os.Args[2:])
+		os.Args = append([]string{os.Args[0], c}, args...)
+		cmd = c
 	}
 
 	switch cmd {
@@ -140,184 +328,967 @@ func main() {
 		os.Exit(0)
 	case "server":
 		var addr, key string
-		flags.StringVar(&addr, "dial", "127.0.0.1:22", "dial addr = host:port")
-		flags.StringVar(&key, "key", "sample", "connection key")
+		flags.StringVar(&addr, "dial", "localhost:22", "dial addr = host:port")
+		peerFlags(flags, &key)
+		flags.IntVar(&dialRetries, "dial-retries", dialRetries, "dial retry count on failure")
+		flags.DurationVar(&dialRetryInterval, "dial-retry-interval", dialRetryInterval, "first dial retry interval (doubled each retry)")
+		flags.Var(&allowTargets, "allow", "additional host:port clients may forward to (repeatable)")
+		flags.Var(routes, "route", "named destination = name:host:port (repeatable)")
+		flags.Var(rewrites, "rewrite", "dial host:port instead of a requested one = requested=dialed (repeatable, -allow checks dialed)")
+		flags.Var(sniRoutes, "sni", "route sni channels by TLS server name = name=host:port, name may be *.domain (repeatable)")
+		flags.StringVar(&sniDefault, "sni-default", "", "destination of sni channels without a matching -sni route (empty = refuse)")
+		flags.DurationVar(&sniTimeout, "sni-timeout", sniTimeout, "refuse sni channels whose TLS client hello takes longer")
+		var resolverAddr string
+		flags.StringVar(&resolverAddr, "resolver", "", "DNS server = ip:port for resolving dial targets")
+		flags.BoolVar(&resolverFallback, "resolver-fallback", false, "retry with the system resolver when -resolver fails")
+		flags.Var(&allowPeers.flags, "allow-peer", "only accept peers with this identity fingerprint (repeatable)")
+		flags.StringVar(&allowPeers.file, "allow-peers", "", "file of allowed identity fingerprints, one per line")
+		flags.StringVar(&banner.file, "banner-file", "", fmt.Sprintf("notice of at most %d bytes clients print to stderr on connect", maxBanner))
+		var embedded bool
+		var hostKey, authorizedKeys string
+		flags.BoolVar(&embedded, "embedded-ssh", false, "serve a built-in ssh server instead of dialing -dial")
+		flags.StringVar(&hostKey, "host-key", "ssh_host_key", "embedded ssh host key file (created if missing)")
+		flags.StringVar(&authorizedKeys, "authorized-keys", os.ExpandEnv("$HOME/.ssh/authorized_keys"), "embedded ssh authorized keys")
+		flags.BoolVar(&once, "once", false, "serve a single session, then exit")
+		flags.BoolVar(&acceptOffers, "answerer", true, "answer client offers; false refuses them, so clients must run with -answerer")
+		var signalSelf bool
+		var signalListen string
+		flags.BoolVar(&signalSelf, "signal-self", false, "host the signaling server in this process; clients point -signaling here")
+		flags.StringVar(&signalListen, "signal-listen", ":8080", "with -signal-self, signaling listen addr = host:port")
+		flags.StringVar(&proxyProtocol, "proxy-protocol", "", "send a PROXY protocol header (v1 or v2) with the client address to dialed destinations")
+		flags.DurationVar(&handshakeTimeout, "handshake-timeout", handshakeTimeout, "with -once or -max-concurrent-handshakes, fail when the data channel is not open by then")
+		flags.IntVar(&maxHandshakes, "max-concurrent-handshakes", 0, "set up at most this many sessions at a time, pulling no more offers meanwhile (0 = unlimited)")
+		flags.DurationVar(&handshakeQueueTimeout, "handshake-queue-timeout", handshakeQueueTimeout, "refuse an offer that waited this long for a -max-concurrent-handshakes slot")
 		if err := flags.Parse(os.Args[2:]); err != nil {
-			log.Fatalln(err)
+			fatalConfig(err)
 		}
+		exportProfile(cmd, flags, os.Args[2:])
+		if proxyProtocol != "" {
+			if _, err := proxyHeader(proxyProtocol, nil, nil); err != nil {
+				fatalConfig(err)
+			}
+		}
+		if sniDefault != "" {
+			if _, _, err := net.SplitHostPort(sniDefault); err != nil {
+				fatalConfig("invalid -sni-default:", err)
+			}
+		}
+		setupPeer()
+		setupHandshakes()
+		if signalSelf {
+			serveSignaling(signalListen)
+			if signalingURL == signaling.URI {
+				_, port, _ := net.SplitHostPort(signalListen)
+				signalingURL = "http://" + net.JoinHostPort("localhost", port)
+			}
+		}
+		if resolverAddr != "" {
+			var err error
+			if resolver, err = newResolver(resolverAddr); err != nil {
+				fatalConfig(err)
+			}
+		}
+		if embedded {
+			var err error
+			if sshd, err = newEmbeddedSSH(hostKey, authorizedKeys); err != nil {
+				fatalConfig(err)
+			}
+		}
+		reload := func() error {
+			if err := allowPeers.load(); err != nil {
+				return err
+			}
+			return loadBanner()
+		}
+		if err := reload(); err != nil {
+			fatalConfig(err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reload(); err != nil {
+					log.Println("reload failed:", err)
+				}
+			}
+		}()
+		controlCommands["reload"] = func(args []string) (interface{}, error) {
+			return nil, reload()
+		}
+		serveControl(controlSocket)
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGINT)
 		ctx, cancel := context.WithCancel(context.Background())
-		go serve(ctx, key, addr)
-		<-sig
-		cancel()
+		done := make(chan error, 1)
+		go func() { done <- serve(ctx, room(key), addr) }()
+		select {
+		case <-sig:
+			cancel()
+			closeSessions()
+		case err := <-done:
+			if err != nil {
+				fatal(err)
+			}
+		}
 	case "client":
 		var addr, key string
-		flags.StringVar(&addr, "listen", "127.0.0.1:2222", "listen addr = host:port")
-		flags.StringVar(&key, "key", "sample", "connection key")
+		var specs stringsFlag
+		var stdin, eager bool
+		flags.StringVar(&addr, "listen", "localhost:2222", "listen addr = host:port")
+		peerFlags(flags, &key)
+		flags.Var(&specs, "forward", "additional forward = [bind:]port:[host:]hostport[:maxconn=N[:queue=N[:queue-timeout=D]]][:name=NAME][:app=git|ssh] (repeatable)")
+		flags.BoolVar(&stdin, "stdin", false, "read add/remove forward commands from stdin")
+		flags.BoolVar(&eager, "eager", false, "keep a tunnel for -listen established ahead of the next connection")
+		flags.BoolVar(&askOffer, "answerer", false, "ask the server to send the offer and answer it here")
+		flags.BoolVar(&listenFallback, "listen-fallback", false, "when a listen port is in use, take the next free one")
+		flags.Var(&sshHostKeys, "ssh-hostkey", "refuse -listen connections whose SSH host key has another fingerprint = SHA256:... (repeatable)")
+		flags.BoolVar(&sshHostKeyWarn, "ssh-hostkey-warn", false, "only log a -ssh-hostkey mismatch")
+		flags.StringVar(&clientName, "client-name", "", "name shown in server logs and status for this client (not authenticated)")
+		flags.DurationVar(&handshakeTimeout, "handshake-timeout", handshakeTimeout, "close a local connection whose data channel is not open by then")
+		flags.StringVar(&appHint, "app-hint", "", "tunneled application, git or ssh, for clearer failure messages (forwards take app=)")
+		flags.BoolVar(&preferIPv6, "prefer-ipv6", false, "offer IPv6 candidates only, falling back to IPv4 after -ipv6-timeout")
+		flags.DurationVar(&ipv6Timeout, "ipv6-timeout", ipv6Timeout, "with -prefer-ipv6, how long the IPv6 attempt may take to connect")
+		flags.Var(&allowSources, "allow-source", "only accept local connections from these networks = CIDR[,CIDR...] (repeatable, IPv4 or IPv6)")
+		flags.IntVar(&reconnectMaxAttempts, "reconnect-max-attempts", 0, "close the listeners and exit 7 once this many tunnels in a row failed to open (0 = never)")
+		flags.BoolVar(&reconnectFastFail, "reconnect-fast-fail", false, "after a tunnel failed to open, refuse local connections while the next attempt is in progress")
+		flags.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false, "local connections start with a PROXY protocol header (v1 or v2); pass its source to the server")
 		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		if appHint != "" && !appHints[appHint] {
+			fatalConfig(appHintError(appHint))
+		}
+		if reconnectMaxAttempts < 0 {
+			fatalConfig("-reconnect-max-attempts must not be negative")
+		}
+		if acceptProxyProtocol && eager {
+			fatalConfig("-eager sets up tunnels before the PROXY protocol header names a source; drop one of -eager and -accept-proxy-protocol")
+		}
+		for _, pin := range sshHostKeys {
+			if !strings.HasPrefix(pin, "SHA256:") {
+				fatalConfig(fmt.Sprintf("invalid -ssh-hostkey %q: want SHA256:... as printed by ssh-keygen -l", pin))
+			}
+		}
+		if clientName != "" && !validClientName(clientName) {
+			fatalConfig(fmt.Sprintf("invalid -client-name %q: up to %d of A-Z a-z 0-9 . _ @ : -", clientName, maxClientName))
+		}
+		exportProfile(cmd, flags, os.Args[2:])
+		setupPeer()
+		if err := checkSchema(); err != nil {
+			fatal(err)
+		}
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT)
+		ctx, cancel := context.WithCancel(context.Background())
+		loadInherited()
+		fw := &forwarder{ctx: ctx, key: room(key), m: map[string]*forward{}}
+		if err := fw.add(&forward{listen: addr, eager: eager}); err != nil {
 			log.Fatalln(err)
 		}
+		for _, spec := range specs {
+			fs, err := parseForward(spec)
+			if err != nil {
+				fatalConfig(err)
+			}
+			if err := fw.add(fs...); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if stdin {
+			go fw.commands(os.Stdin)
+		}
+		reconnects.mu.Lock()
+		reconnects.giveUp = fw.closeAll
+		reconnects.mu.Unlock()
+		statusFuncs["forwards"] = fw.status
+		expvar.Publish("forwards", expvar.Func(fw.conns))
+		serveControl(controlSocket)
+		<-sig
+		cancel()
+	case "ctl":
+		flags.StringVar(&controlSocket, "control-socket", "ssh-p2p.sock", "control socket path")
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		if err := ctl(controlSocket, flags.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "probe-ice":
+		var timeout time.Duration
+		var asJSON bool
+		flags.DurationVar(&timeout, "timeout", 2*time.Second, "per server timeout")
+		flags.BoolVar(&asJSON, "json", false, "print results as JSON")
+		flags.StringVar(&iceDiscoveryURL, "ice-discovery-url", "", "fetch ICE servers from URL (JSON iceServers + ttl)")
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		startDiscovery()
+		if err := probeICE(timeout, asJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCode(err))
+		}
+	case "soak":
+		var key string
+		var asJSON bool
+		opts := soakOptions{}
+		peerFlags(flags, &key)
+		flags.StringVar(&opts.remote, "remote", "", "destination = route or host:port; empty for the server's -dial (must echo)")
+		flags.IntVar(&opts.conns, "conns", 10, "number of tunnels")
+		flags.Float64Var(&opts.rate, "rate", 1, "tunnels opened per second while ramping up")
+		flags.DurationVar(&opts.duration, "duration", 30*time.Second, "echo data over each tunnel this long")
+		flags.DurationVar(&opts.setupTimeout, "setup-timeout", 30*time.Second, "fail a tunnel whose first echo takes longer")
+		flags.IntVar(&opts.chunk, "chunk", 4096, "bytes per echo round trip")
+		flags.BoolVar(&asJSON, "json", false, "print the summary as JSON")
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		if opts.conns < 1 || opts.rate <= 0 || opts.chunk < 1 {
+			fatalConfig("-conns, -rate and -chunk must be positive")
+		}
+		exportProfile(cmd, flags, os.Args[2:])
+		setupPeer()
+		ctx, cancel := context.WithCancel(context.Background())
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT)
+		go func() {
+			<-sig
+			cancel()
+		}()
+		if err := soak(ctx, room(key), opts, asJSON); err != nil {
+			fatal(err)
+		}
+	case "replay-signaling":
+		var key, addr string
+		var speed float64
+		var timeout time.Duration
+		peerFlags(flags, &key)
+		flags.StringVar(&addr, "dial", "localhost:22", "replaying a server recording, dial addr = host:port for sessions set up by offer")
+		flags.Float64Var(&speed, "speed", 1, "replay this many times faster than recorded (0 = without waiting)")
+		flags.DurationVar(&timeout, "timeout", 10*time.Second, "wait this long for the data channel before ending the replay")
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		if flags.NArg() != 1 {
+			fatalConfig("replay-signaling needs the recording FILE")
+		}
+		if speed < 0 {
+			fatalConfig("-speed must not be negative")
+		}
+		setupPeer()
+		if err := replaySignaling(flags.Arg(0), key, addr, speed, timeout); err != nil {
+			fatal(err)
+		}
+	case "connect":
+		var key, remote string
+		var stdio bool
+		peerFlags(flags, &key)
+		flags.StringVar(&remote, "remote", "", "destination = route or host:port; empty for the server's -dial")
+		flags.BoolVar(&stdio, "stdio", false, "tunnel stdin and stdout (e.g. as an ssh ProxyCommand)")
+		flags.BoolVar(&askOffer, "answerer", false, "ask the server to send the offer and answer it here")
+		flags.DurationVar(&handshakeTimeout, "handshake-timeout", handshakeTimeout, "fail when the data channel is not open by then")
+		flags.StringVar(&clientName, "client-name", "", "name shown in server logs and status for this client (not authenticated)")
+		flags.StringVar(&appHint, "app-hint", "", "tunneled application, git or ssh, for clearer failure messages")
+		flags.BoolVar(&preferIPv6, "prefer-ipv6", false, "offer IPv6 candidates only, falling back to IPv4 after -ipv6-timeout")
+		flags.DurationVar(&ipv6Timeout, "ipv6-timeout", ipv6Timeout, "with -prefer-ipv6, how long the IPv6 attempt may take to connect")
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		if appHint != "" && !appHints[appHint] {
+			fatalConfig(appHintError(appHint))
+		}
+		if !stdio {
+			fatalConfig("connect needs -stdio; use client to listen on a port")
+		}
+		if clientName != "" && !validClientName(clientName) {
+			fatalConfig(fmt.Sprintf("invalid -client-name %q: up to %d of A-Z a-z 0-9 . _ @ : -", clientName, maxClientName))
+		}
+		exportProfile(cmd, flags, os.Args[2:])
+		setupPeer()
+		if err := checkSchema(); err != nil {
+			fatal(err)
+		}
+		if err := connectStdio(context.Background(), room(key), remote, handshakeTimeout); err != nil {
+			fatal(err)
+		}
+	case "signal":
+		var addr string
+		flags.StringVar(&addr, "listen", ":8080", "listen addr = host:port")
+		flags.Int64Var(&maxSDPSize, "max-sdp-size", maxSDPSize, "reject pushed SDPs larger than this many bytes")
+		flags.StringVar(&signalTLSCert, "tls-cert", "", "serve HTTPS with this certificate file (reloaded when it changes)")
+		flags.StringVar(&signalTLSKey, "tls-key", "", "private key file for -tls-cert")
+		logFlags(flags)
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		if (signalTLSCert == "") != (signalTLSKey == "") {
+			fatalConfig("-tls-cert and -tls-key go together")
+		}
+		exportProfile(cmd, flags, os.Args[2:])
+		setupLog()
+		serveSignaling(addr)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT)
+		<-sig
+	case "relay":
+		var addr, metrics string
+		r := &relay{waiting: map[string]*relayWaiter{}, active: map[string]bool{}}
+		flags.StringVar(&addr, "listen", ":9000", "listen addr = host:port")
+		flags.IntVar(&r.maxConns, "max-conns", 0, "reject endpoints beyond this many waiting or paired connections (0 = unlimited)")
+		flags.StringVar(&r.token, "token", "", "require this token from peers")
+		flags.DurationVar(&r.timeout, "timeout", 30*time.Second, "unpaired connection timeout")
+		flags.StringVar(&metrics, "metrics", "", "serve expvar metrics on addr = host:port")
+		logFlags(flags)
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			fatalConfig(err)
+		}
+		exportProfile(cmd, flags, os.Args[2:])
+		setupLog()
 		l, err := net.Listen("tcp", addr)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		log.Println("listen:", addr)
+		log.Println("relay listen:", addr)
+		if metrics != "" {
+			expvar.Publish("relay_pairs", &relayPairs)
+		}
+		serveMetrics(metrics)
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGINT)
-		ctx, cancel := context.WithCancel(context.Background())
-		go func() {
-			for {
-				sock, err := l.Accept()
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				go connect(ctx, key, sock)
-			}
-		}()
+		go r.serve(l)
 		<-sig
-		cancel()
 	}
 }
 
+// maxMessage bounds the data channel messages received. pions/webrtc
+// v1.2.0 reads each message into an 8192 byte buffer and silently drops
+// the rest.
+const maxMessage = 8192
+
 type sendWrap struct {
 	*webrtc.RTCDataChannel
+	tap   *tapStream
+	stall *stallWatch
+	aead  *aeadStream
+	size  int
+	done  <-chan struct{}
+	write *writeWatch
 }
 
+// Write sends b in messages of at most the negotiated size, sealed with
+// -aead, once a quiescing pause is over.
 func (s *sendWrap) Write(b []byte) (int, error) {
-	err := s.RTCDataChannel.Send(datachannel.PayloadBinary{Data: b})
-	return len(b), err
+	if err := pause.hold(s.done); err != nil {
+		return 0, err
+	}
+	s.tap.record(tapSend, b)
+	size := s.size
+	if s.aead != nil {
+		size -= s.aead.aead.Overhead()
+	}
+	for n := 0; n < len(b); n += size {
+		chunk := b[n:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		data := chunk
+		if s.aead != nil {
+			data = s.aead.seal(chunk)
+		}
+		s.write.start()
+		s.stall.sending.Lock()
+		err := s.RTCDataChannel.Send(datachannel.PayloadBinary{Data: data})
+		s.stall.sending.Unlock()
+		s.write.done()
+		if err != nil {
+			return n, err
+		}
+		s.stall.sent()
+		quota.add(len(chunk), 0)
+	}
+	return len(b), nil
+}
+
+// dial connects to addr, retrying with backoff to ride out a briefly
+// unavailable target (e.g. sshd restarting).
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Resolver: resolver}
+	interval := dialRetryInterval
+	for i := 0; ; i++ {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		var dnsErr *net.DNSError
+		if err != nil && resolver != nil && resolverFallback && errors.As(err, &dnsErr) {
+			log.Println("resolver failed, using system resolver:", err)
+			var sys net.Dialer
+			conn, err = sys.DialContext(ctx, "tcp", addr)
+		}
+		if err == nil {
+			tuneTCP(conn)
+			return conn, nil
+		}
+		if i >= dialRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("dial retry %d/%d in %s: %v", i+1, dialRetries, interval, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
 }
 
-func serve(ctx context.Context, key, addr string) {
+// newResolver returns a resolver querying the DNS server at addr (ip:port).
+func newResolver(addr string) (*net.Resolver, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver %q: %v", addr, err)
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid resolver %q: not an IP address", addr)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// expire rotates s once maxLifetime (plus up to 10% jitter, so tunnels
+// sharing a lifetime don't rotate at once) has elapsed. A session not
+// carrying a stream yet, such as a pre-warmed one, closes at once so that
+// no new stream starts on it; one in use is drained, given
+// -max-lifetime-grace to end by itself before it is closed.
+func expire(s *session) {
+	if maxLifetime <= 0 {
+		return
+	}
+	d := maxLifetime + time.Duration(rand.Int63n(int64(maxLifetime)/10+1))
+	grace := maxLifetimeGrace
+	time.AfterFunc(d, func() {
+		if !s.inUse() {
+			s.logf("session %s: max lifetime reached: %s", s.id, d)
+			s.Close()
+			return
+		}
+		s.logf("session %s: max lifetime reached: %s, draining for up to %s", s.id, d, grace)
+		select {
+		case <-s.done:
+			return
+		case <-time.After(grace):
+		}
+		s.logf("session %s: still in use after %s, closing", s.id, grace)
+		s.Close()
+	})
+}
+
+// target resolves the destination a client asked for in the data channel
+// label. Only the -dial address and -allow entries may be reached; the
+// check applies after -rewrite.
+func target(addr, label string) (string, error) {
+	if label == "" || label == "data" {
+		return addr, nil
+	}
+	if !strings.Contains(label, ":") {
+		if dst, ok := routes[label]; ok {
+			return dst, nil
+		}
+		return "", fmt.Errorf("%w: unknown route: %s", errAuthRejected, label)
+	}
+	host, port, err := net.SplitHostPort(label)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host, _, _ = net.SplitHostPort(addr)
+	}
+	dst := net.JoinHostPort(host, port)
+	if to, ok := rewrites[dst]; ok {
+		dst = to
+	}
+	if sameTarget(dst, addr) {
+		return dst, nil
+	}
+	for _, v := range allowTargets {
+		if sameTarget(v, dst) {
+			return dst, nil
+		}
+	}
+	return "", fmt.Errorf("%w: destination not allowed: %s", errAuthRejected, dst)
+}
+
+// sameTarget reports whether the host:port addresses a and b name one
+// destination. localhost, 127.0.0.1 and ::1 are all the loopback host, so
+// that -allow 127.0.0.1:22 matches the default -dial localhost:22; other
+// addresses and ports compare by value, names case insensitively.
+func sameTarget(a, b string) bool {
+	ah, ap, err := net.SplitHostPort(a)
+	if err != nil {
+		return a == b
+	}
+	bh, bp, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+	return targetHost(ah) == targetHost(bh) && targetPort(ap) == targetPort(bp)
+}
+
+func targetHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" {
+		return "loopback"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.Equal(net.IPv4(127, 0, 0, 1)) || ip.Equal(net.IPv6loopback) {
+		return "loopback"
+	}
+	return ip.String()
+}
+
+func targetPort(port string) string {
+	n, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return port
+	}
+	return strconv.Itoa(n)
+}
+
+// routeTag returns the forward name of a data channel label: the label of
+// a -route (or -sni) channel. Other labels are not names the server
+// knows, which would leave metrics open to any client chosen value.
+func routeTag(label string) string {
+	if _, ok := routes[label]; ok || (label == sniLabel && sniEnabled()) {
+		return label
+	}
+	return ""
+}
+
+// open connects s to the destination requested by a data channel label.
+func open(ctx context.Context, s *session, addr, label string) (net.Conn, string, error) {
+	if sshd != nil && (label == "" || label == "data") {
+		return sshd.pipe(), "embedded-ssh", nil
+	}
+	if label == sniLabel && sniEnabled() {
+		return newSNIConn(ctx, s), sniLabel, nil
+	}
+	dst, err := target(addr, label)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := dial(ctx, dst)
+	return conn, dst, err
+}
+
+// serve handles offers, and offer requests from -answerer clients, until
+// ctx is done. With -once it takes the first accepted one only and returns
+// when that session ends, with an error when its data channel never opened.
+func serve(ctx context.Context, key, addr string) error {
 	log.Println("server started")
-	for v := range pull(ctx, key) {
+	pctx, stop := context.WithCancel(ctx)
+	defer stop()
+	for v := range pull(pctx, key) {
 		log.Printf("info: %#v", v)
-		pc, err := webrtc.New(defaultRTCConfiguration)
-		if err != nil {
-			log.Println("rtc error:", err)
+		if err := allowPeers.check(v); err != nil {
+			log.Println("peer denied:", err)
 			continue
 		}
-		ssh, err := net.Dial("tcp", addr)
-		if err != nil {
-			log.Println("ssh dial filed:", err)
-			pc.Close()
+		if pause.refusing() {
+			log.Println("paused, refusing session from", v.Source)
 			continue
 		}
-		pc.OnICEConnectionStateChange(func(state ice.ConnectionState) {
-			log.Print("pc ice state change:", state)
-			if state == ice.ConnectionStateDisconnected {
-				pc.Close()
-				ssh.Close()
-			}
-		})
-		pc.OnDataChannel(func(dc *webrtc.RTCDataChannel) {
-			//dc.Lock()
-			dc.OnOpen(func() {
-				log.Print("dial:", addr)
-				io.Copy(&sendWrap{dc}, ssh)
-				log.Println("disconnected")
-			})
-			dc.Onmessage(func(payload datachannel.Payload) {
-				switch p := payload.(type) {
-				case *datachannel.PayloadBinary:
-					_, err := ssh.Write(p.Data)
-					if err != nil {
-						log.Println("ssh write failed:", err)
-						pc.Close()
-						return
-					}
-				}
-			})
-			//dc.Unlock()
-		})
-		if err := pc.SetRemoteDescription(webrtc.RTCSessionDescription{
-			Type: webrtc.RTCSdpTypeOffer,
-			Sdp:  string(v.SDP),
-		}); err != nil {
-			log.Println("rtc error:", err)
-			pc.Close()
-			ssh.Close()
+		if err := acquireHandshake(); err != nil {
+			log.Println("offer refused:", err, v.Source)
 			continue
 		}
-		answer, err := pc.CreateAnswer(nil)
-		if err != nil {
-			log.Println("rtc error:", err)
-			pc.Close()
-			ssh.Close()
+		var s *session
+		var err error
+		switch {
+		case v.SDP == "":
+			s, err = offer(ctx, key, addr, v)
+		case !acceptOffers:
+			freeHandshake()
+			log.Println("offer refused (-answerer=false), the client needs -answerer:", v.Source)
 			continue
+		default:
+			s, err = accept(ctx, key, addr, v)
 		}
-		if err := push(v.Source, key, answer.Sdp); err != nil {
+		if err != nil {
+			freeHandshake()
 			log.Println("rtc error:", err)
-			pc.Close()
-			ssh.Close()
+			if once {
+				return err
+			}
 			continue
 		}
+		s.holdHandshake()
+		if once {
+			stop()
+			return s.wait(handshakeTimeout)
+		}
 	}
+	return ctx.Err()
 }
 
-func connect(ctx context.Context, key string, sock net.Conn) {
-	id := uuid.New().String()
-	log.Println("client id:", id)
-	pc, err := webrtc.New(defaultRTCConfiguration)
+// newPeer creates a PeerConnection and its session, which closes when ICE
+// stays disconnected for -ice-disconnect-timeout or -max-lifetime passed.
+func newPeer(id string) (*session, error) {
+	if quota.exceeded() {
+		return nil, errQuota
+	}
+	gather := time.Now()
+	pc, err := webrtc.New(rtcConfiguration())
 	if err != nil {
-		log.Println("rtc error:", err)
-		return
+		return nil, err
 	}
-	pc.OnICEConnectionStateChange(func(state ice.ConnectionState) {
-		log.Print("pc ice state change:", state)
-	})
-	dc, err := pc.CreateDataChannel("data", nil)
+	s, err := newSession(id, pc)
 	if err != nil {
-		log.Println("create dc failed:", err)
 		pc.Close()
-		return
+		return nil, err
+	}
+	s.trace = newSessionTrace(gather)
+	s.trace.span(traceGather, gather, s.started)
+	expire(s)
+	var w iceWatch
+	pc.OnICEConnectionStateChange(func(state ice.ConnectionState) {
+		s.logf("pc ice state change:%v", state)
+		switch state {
+		case ice.ConnectionStateChecking:
+			s.trace.begin(traceICE)
+		case ice.ConnectionStateConnected:
+			retries.reset()
+			resetAttempts()
+			s.iceConnected()
+			s.trace.end(traceICE)
+			s.trace.begin(traceHandshake)
+		}
+		w.update(s, state)
+	})
+	return s, nil
+}
+
+// openHold is how long the side that created a data channel holds back
+// its first data while the peer has not sent any. pions/webrtc v1.2.0
+// deadlocks accepting a channel when data arrives right behind the open
+// message, before the acceptor wrote its acknowledgement.
+const openHold = 200 * time.Millisecond
+
+// messageData returns the stream bytes a received message carries. Peers
+// send binary messages; text ones, which browsers send for strings, carry
+// the same bytes.
+func messageData(payload datachannel.Payload) ([]byte, bool) {
+	switch p := payload.(type) {
+	case *datachannel.PayloadBinary:
+		return p.Data, true
+	case *datachannel.PayloadString:
+		return p.Data, true
 	}
-	//dc.Lock()
+	return nil, false
+}
+
+// bridge copies between conn and dc once the channel is open; either end
+// finishing closes s. created is set when dc was created on this side.
+func bridge(s *session, dc *webrtc.RTCDataChannel, conn net.Conn, created bool) {
+	ts := capture.stream()
+	spoke := make(chan struct{}, 1)
 	dc.OnOpen(func() {
-		io.Copy(&sendWrap{dc}, sock)
-		pc.Close()
-		log.Println("disconnected")
+		s.opened()
+		if err := s.writeProxyHeader(conn); err != nil {
+			s.logf("proxy header failed: %v", err)
+			s.Close()
+			return
+		}
+		send, _, err := s.aeadStreams()
+		if err != nil {
+			s.logf("%v", err)
+			s.fail(err)
+			return
+		}
+		go watchStall(s, stallTimeout, stallAction)
+		go watchWrites(s)
+		if created {
+			select {
+			case <-spoke:
+			case <-time.After(openHold):
+			}
+		}
+		go sendKeepalives(s, dc)
+		_, err = io.Copy(&sendWrap{dc, ts, &s.stall, send, s.messageSize(), s.done, &s.write}, s.appReader(conn))
+		if _, ok := conn.(halfCloser); ok && err == nil {
+			s.logf("local end closed, relaying the remote end until it closes")
+			return
+		}
+		s.logf("disconnected")
+		s.Close()
 	})
 	dc.OnMessage(func(payload datachannel.Payload) {
-		switch p := payload.(type) {
-		case *datachannel.PayloadBinary:
-			_, err := sock.Write(p.Data)
-			if err != nil {
-				log.Println("sock write failed:", err)
-				pc.Close()
-				return
-			}
+		if isKeepalive(s, payload) {
+			s.stall.received()
+			return
+		}
+		data, ok := messageData(payload)
+		if !ok {
+			return
+		}
+		_, recv, err := s.aeadStreams()
+		if err == nil && recv != nil {
+			data, err = recv.open(data)
+		}
+		if err != nil {
+			s.logf("%v", err)
+			go s.fail(err)
+			return
+		}
+		select {
+		case spoke <- struct{}{}:
+		default:
+		}
+		s.stall.received()
+		s.appReceived(data)
+		quota.add(0, len(data))
+		ts.record(tapRecv, data)
+		if !s.checkHostKey(data) {
+			return
+		}
+		if err := s.writeProxyHeader(conn); err != nil {
+			s.logf("proxy header failed: %v", err)
+			s.Close()
+			return
+		}
+		if err := writeLocal(conn, data); err != nil {
+			s.logf("write failed: %v", err)
+			s.Close()
 		}
 	})
-	//dc.Unlock()
-	log.Print("DataChannel:", dc)
+}
+
+// sendOffer pushes an offer for s to dst and applies the answer pulled on
+// src. A client checks the answer agrees to its -aead choice.
+func sendOffer(s *session, dst, src string, client bool) error {
+	offer, err := s.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
 	go func() {
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
-		for v := range pull(ctx, id) {
+		for v := range pull(ctx, src) {
 			log.Printf("info: %#v", v)
-			if err := pc.SetRemoteDescription(webrtc.RTCSessionDescription{
+			s.trace.end(traceSignaling)
+			s.stall.keepalive(v)
+			if client {
+				if err := s.confirmAEAD(v); err != nil {
+					s.logf("%v", err)
+					s.fail(err)
+					return
+				}
+				showBanner(v.Banner)
+			} else if err := s.checkAnswer(v); err != nil {
+				s.logf("answer refused: %v", err)
+				s.fail(err)
+				return
+			}
+			if err := s.pc.SetRemoteDescription(webrtc.RTCSessionDescription{
 				Type: webrtc.RTCSdpTypeAnswer,
 				Sdp:  string(v.SDP),
 			}); err != nil {
-				log.Println("rtc error:", err)
-				pc.Close()
+				s.logf("rtc error: %v", err)
+				s.Close()
 				return
 			}
+			s.reflexive(offer.Sdp, v.SDP)
+			s.negotiateMessageSize(v.SDP)
+			s.setName(v)
 			return
 		}
 	}()
-	offer, err := pc.CreateOffer(nil)
+	s.trace.begin(traceSignaling)
+	return push(s, dst, src, offer.Sdp)
+}
+
+// sendAnswer answers offer for s, replying from src.
+func sendAnswer(s *session, offer signaling.ConnectInfo, src string) error {
+	if err := s.pc.SetRemoteDescription(webrtc.RTCSessionDescription{
+		Type: webrtc.RTCSdpTypeOffer,
+		Sdp:  string(offer.SDP),
+	}); err != nil {
+		return err
+	}
+	answer, err := s.pc.CreateAnswer(nil)
 	if err != nil {
-		log.Println("create offer error:", err)
-		pc.Close()
-		return
+		return err
 	}
-	if err := push(key, id, offer.Sdp); err != nil {
-		log.Println("push error:", err)
-		pc.Close()
-		return
+	s.reflexive(answer.Sdp, offer.SDP)
+	s.negotiateMessageSize(offer.SDP)
+	return push(s, offer.Source, src, answer.Sdp)
+}
+
+// accept sets up the session for one offer and pushes the answer.
+func accept(ctx context.Context, key, addr string, v signaling.ConnectInfo) (*session, error) {
+	s, err := newPeer(v.Source)
+	if err != nil {
+		return nil, err
+	}
+	s.claim(v)
+	s.stall.keepalive(v)
+	if err := s.acceptAEAD(v); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.pc.OnDataChannel(func(dc *webrtc.RTCDataChannel) {
+		s.setForward(routeTag(dc.Label))
+		conn, dst, err := open(ctx, s, addr, dc.Label)
+		if err != nil {
+			s.logf("open failed: %v", err)
+			go s.fail(err)
+			return
+		}
+		if !s.attach(conn, dst) {
+			return
+		}
+		s.logf("dial:%s", dst)
+		s.proxied()
+		bridge(s, dc, conn, false)
+	})
+	s.trace.begin(traceSignaling)
+	if err := sendAnswer(s, v, key); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.trace.end(traceSignaling)
+	return s, nil
+}
+
+// offer serves the request of an -answerer client: the server opens the
+// destination the client asked for and offers the data channel itself.
+func offer(ctx context.Context, key, addr string, v signaling.ConnectInfo) (*session, error) {
+	s, err := newPeer(v.Source)
+	if err != nil {
+		return nil, err
+	}
+	s.claim(v)
+	s.stall.keepalive(v)
+	if err := s.acceptAEAD(v); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.setForward(routeTag(v.Label))
+	conn, dst, err := open(ctx, s, addr, v.Label)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if !s.attach(conn, dst) {
+		return nil, errors.New("session closed")
+	}
+	s.logf("dial:%s", dst)
+	s.proxied()
+	dc, err := s.pc.CreateDataChannel(v.Label, nil)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	bridge(s, dc, conn, true)
+	if err := sendOffer(s, v.Source, uuid.New().String(), false); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect tunnels sock to remote on the server side; an empty remote means
+// the server's -dial address. name tags the session with its forward.
+// With -answerer the client asks the server for an offer instead of
+// sending one.
+func connect(ctx context.Context, key, remote, name, app string, sock net.Conn) (*session, error) {
+	if !preferIPv6 {
+		return connectFamily(ctx, key, remote, name, app, "", sock)
+	}
+	s, err := connectFamily(ctx, key, remote, name, app, familyIPv6, sock)
+	if err != nil || !s.fallBackIPv4() {
+		return s, err
+	}
+	return connectFamily(ctx, key, remote, name, app, familyIPv4, sock)
+}
+
+// connectFamily is one attempt of connect, advertising only candidates of
+// family unless that is empty.
+func connectFamily(ctx context.Context, key, remote, name, app, family string, sock net.Conn) (*session, error) {
+	id := uuid.New().String()
+	s, err := newPeer(id)
+	if err != nil {
+		log.Println("rtc error:", err)
+		sock.Close()
+		return nil, err
+	}
+	s.wantFamily = family
+	s.setForward(name)
+	if app != "" {
+		s.app = &appWatch{hint: app}
+	}
+	s.logf("client id: %s", id)
+	s.attach(sock, remote)
+	s.setOrigin(localOrigin(sock))
+	if aeadRequired {
+		if err := s.wantAEAD(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	label := remote
+	if label == "" {
+		label = "data"
+		if len(sshHostKeys) > 0 {
+			s.hostKey = &hostKeyCheck{}
+		}
+	}
+	if askOffer {
+		s.pc.OnDataChannel(func(dc *webrtc.RTCDataChannel) {
+			bridge(s, dc, sock, false)
+		})
+		go func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			for v := range pull(ctx, id) {
+				log.Printf("info: %#v", v)
+				s.stall.keepalive(v)
+				if err := s.confirmAEAD(v); err != nil {
+					s.logf("%v", err)
+					s.fail(err)
+					return
+				}
+				showBanner(v.Banner)
+				if err := sendAnswer(s, v, id); err != nil {
+					s.logf("rtc error: %v", err)
+					s.Close()
+				}
+				s.trace.end(traceSignaling)
+				return
+			}
+		}()
+		s.trace.begin(traceSignaling)
+		if err := request(s, key, id, label); err != nil {
+			s.logf("push error: %v", err)
+			s.fail(err)
+		}
+		return s, nil
+	}
+	dc, err := s.pc.CreateDataChannel(label, nil)
+	if err != nil {
+		s.logf("create dc failed: %v", err)
+		s.Close()
+		return s, nil
+	}
+	bridge(s, dc, sock, true)
+	s.logf("DataChannel:%v", dc)
+	if err := sendOffer(s, key, id, true); err != nil {
+		s.logf("push error: %v", err)
+		s.fail(err)
 	}
+	return s, nil
 }
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nobonobo/ssh-p2p/signaling"
+	"github.com/pions/webrtc"
+)
+
+func FuzzDecodeInfo(f *testing.F) {
+	for _, info := range []signaling.ConnectInfo{
+		{Version: signaling.Version, Source: "a", SDP: testSDP, Origin: "192.0.2.1:22"},
+		{Version: signaling.Version, Source: "a", Label: "data", Nonce: "00", Time: 1},
+		{Version: signaling.Version + 1, Source: "a", SDP: "v=0"},
+	} {
+		b, err := json.Marshal(info)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte(`{"sdp":`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		info, err := decodeInfo(ioutil.NopCloser(bytes.NewReader(b)))
+		if err != nil {
+			return
+		}
+		if !signaling.Compatible(info.Version) || int64(len(info.SDP)) > maxSDPSize {
+			t.Fatalf("%q: decoded %+v", b, info)
+		}
+		// what a peer goes on to do with a pulled message
+		var l peerList
+		l.check(info)
+		candidateAddr(info.SDP)
+		remoteMessageSize(info.SDP)
+	})
+}
+
+func withMaxSDPSize(t *testing.T, n int64) {
+	t.Helper()
+	old := maxSDPSize
+	maxSDPSize = n
+	t.Cleanup(func() { maxSDPSize = old })
+}
+
+// withPulls points pull at a signaling backend that hands out msgs, one
+// per pull, then holds further pulls open.
+func withPulls(t *testing.T, msgs ...signaling.ConnectInfo) {
+	t.Helper()
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if len(msgs) == 0 {
+			mu.Unlock()
+			<-r.Context().Done()
+			return
+		}
+		v := msgs[0]
+		msgs = msgs[1:]
+		mu.Unlock()
+		json.NewEncoder(w).Encode(v)
+	}))
+	old := signalingURL
+	signalingURL = ts.URL
+	t.Cleanup(func() {
+		signalingURL = old
+		ts.Close()
+	})
+}
+
+func TestDecodeInfoOversizedSDP(t *testing.T) {
+	withMaxSDPSize(t, 8)
+	b, _ := json.Marshal(signaling.ConnectInfo{Version: signaling.Version, Source: "a", SDP: "v=0123456789"})
+	if _, err := decodeInfo(ioutil.NopCloser(bytes.NewReader(b))); !errors.Is(err, errDropped) {
+		t.Fatalf("got %v, want dropped", err)
+	}
+	b, _ = json.Marshal(signaling.ConnectInfo{Version: signaling.Version, Source: "a", Label: strings.Repeat("x", int(signaling.MaxBodySize(8)))})
+	if _, err := decodeInfo(ioutil.NopCloser(bytes.NewReader(b))); err == nil {
+		t.Fatal("oversized body decoded")
+	}
+}
+
+func TestPullDropsOversizedSDP(t *testing.T) {
+	withMaxSDPSize(t, 8)
+	withPulls(t,
+		signaling.ConnectInfo{Version: signaling.Version, Source: "big", SDP: "v=0123456789"},
+		signaling.ConnectInfo{Version: signaling.Version, Source: "small", SDP: "v=0"},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	select {
+	case v := <-pull(ctx, "room"):
+		if v.Source != "small" {
+			t.Fatalf("pulled the message of %q", v.Source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing pulled")
+	}
+}
+
+// oldSignaling is the signaling server of the schema before ours.
+func oldSignaling(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info signaling.ConnectInfo
+		json.NewDecoder(r.Body).Decode(&info)
+		if info.Version > signaling.Version-1 {
+			http.Error(w, fmt.Sprintf("unsupported schema version %d (server %d)", info.Version, signaling.Version-1), http.StatusConflict)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestCheckSchema(t *testing.T) {
+	old := signalingURL
+	t.Cleanup(func() { signalingURL = old })
+	ts := httptest.NewServer((&signaling.Server{}).Handler())
+	defer ts.Close()
+	signalingURL = ts.URL
+	if err := checkSchema(); err != nil {
+		t.Fatalf("same schema: %v", err)
+	}
+	signalingURL = oldSignaling(t).URL
+	err := checkSchema()
+	if !errors.Is(err, errSignaling) || !strings.Contains(err.Error(), "unsupported schema version") {
+		t.Fatalf("older server: got %v, want the server's refusal", err)
+	}
+}
+
+// TestClientSchemaMismatchExits starts a client in a child process against
+// a signaling server of an older schema, which must exit 3 at startup.
+func TestClientSchemaMismatchExits(t *testing.T) {
+	if url := os.Getenv("SSH_P2P_TEST_SIGNALING"); url != "" {
+		os.Args = []string{"ssh-p2p", "client", "-key", "k", "-listen", "127.0.0.1:0", "-signaling", url}
+		main()
+		t.Fatal("client started")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestClientSchemaMismatchExits$")
+	cmd.Env = append(os.Environ(), "SSH_P2P_TEST_SIGNALING="+oldSignaling(t).URL)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitSignaling {
+		t.Fatalf("got %v, want exit %d\n%s", err, exitSignaling, out)
+	}
+	if !strings.Contains(string(out), "refuses schema version") {
+		t.Fatalf("no schema error:\n%s", out)
+	}
+}
+
+func TestRoom(t *testing.T) {
+	const key = "correct horse battery staple"
+	if got, want := room(key), "5c6fdcbdd5583b04c49c3406032984bd5deb98d3db8b46fbee7848efff6c7dd8"; got != want {
+		t.Fatalf("room(%q) = %s, want %s", key, got, want)
+	}
+	if room(key+"!") == room(key) {
+		t.Fatal("other key, same room")
+	}
+	plainKey = true
+	defer func() { plainKey = false }()
+	if got := room(key); got != key {
+		t.Fatalf("-plain-key room(%q) = %s", key, got)
+	}
+}
+
+// runPeer runs ssh-p2p with args in a child process until the test ends.
+// The child gathers no STUN candidates, so it needs no network.
+func runPeer(t *testing.T, args ...string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestPeersShareRoom$")
+	cmd.Env = append(os.Environ(), "SSH_P2P_TEST_PEER="+strings.Join(args, "\n"))
+	if err := cmd.Start(); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		cmd.Wait()
+	})
+}
+
+// TestPeersShareRoom runs a server and an eager client from their command
+// lines, with and without -plain-key, and checks the server pulls on the
+// very room the client pushes to, with signaling never seeing the key.
+func TestPeersShareRoom(t *testing.T) {
+	if args := os.Getenv("SSH_P2P_TEST_PEER"); args != "" {
+		defaultRTCConfiguration = webrtc.RTCConfiguration{}
+		os.Args = append([]string{"ssh-p2p"}, strings.Split(args, "\n")...)
+		main()
+		return
+	}
+	if testing.Short() {
+		t.Skip("starts a server and a client")
+	}
+	for _, plain := range []bool{false, true} {
+		plain := plain
+		t.Run(fmt.Sprintf("plain-key=%t", plain), func(t *testing.T) {
+			key := "secret-" + uuid.New().String()
+			want := room(key)
+			if plain {
+				want = key
+			}
+			// Each peer signals under a prefix of its own, so that its
+			// requests tell apart from the other's.
+			var mu sync.Mutex
+			paths := map[string]bool{}
+			h := (&signaling.Server{}).Handler()
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				paths[r.URL.Path] = true
+				mu.Unlock()
+				for _, peer := range []string{"/server", "/client"} {
+					r.URL.Path = strings.TrimPrefix(r.URL.Path, peer)
+				}
+				h.ServeHTTP(w, r)
+			}))
+			t.Cleanup(ts.Close)
+			args := []string{"-key", key, fmt.Sprintf("-plain-key=%t", plain)}
+			runPeer(t, append([]string{"server", "-dial", "127.0.0.1:1", "-signaling", ts.URL + "/server"}, args...)...)
+			runPeer(t, append([]string{"client", "-listen", "127.0.0.1:0", "-eager", "-signaling", ts.URL + "/client"}, args...)...)
+			shared := func() (string, bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				for p := range paths {
+					if r := strings.TrimPrefix(p, "/server/pull/"); r != p && paths["/client/push/"+r] {
+						return r, true
+					}
+				}
+				return "", false
+			}
+			deadline := time.Now().Add(20 * time.Second)
+			got, ok := shared()
+			for ; !ok && time.Now().Before(deadline); got, ok = shared() {
+				time.Sleep(50 * time.Millisecond)
+			}
+			if !ok {
+				t.Fatal("the client pushed to no room the server pulls on")
+			}
+			if got != want {
+				t.Errorf("peers met in room %s, want %s", got, want)
+			}
+			if !plain {
+				mu.Lock()
+				defer mu.Unlock()
+				for p := range paths {
+					if strings.Contains(p, key) {
+						t.Errorf("signaling saw the key in %s", p)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestExpireDrains rotates sessions at -max-lifetime: one carrying no
+// stream at once, one in use only after -max-lifetime-grace.
+func TestExpireDrains(t *testing.T) {
+	oldLifetime, oldGrace := maxLifetime, maxLifetimeGrace
+	maxLifetime, maxLifetimeGrace = 100*time.Millisecond, 500*time.Millisecond
+	t.Cleanup(func() { maxLifetime, maxLifetimeGrace = oldLifetime, oldGrace })
+	expiring := func(conn net.Conn, open bool) *session {
+		t.Helper()
+		pc, err := webrtc.New(webrtc.RTCConfiguration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := newSession(uuid.New().String(), pc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		s.attach(conn, "")
+		s.mu.Lock()
+		s.open = open
+		s.mu.Unlock()
+		expire(s)
+		return s
+	}
+	local, _ := net.Pipe()
+	opening := expiring(local, false)
+	warm := expiring(newWarmConn(), true)
+	local, _ = net.Pipe()
+	busy := expiring(local, true)
+	start := time.Now()
+	for name, s := range map[string]*session{"opening": opening, "pre-warmed": warm} {
+		select {
+		case <-s.done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s session still up past its lifetime", name)
+		}
+	}
+	select {
+	case <-busy.done:
+		t.Fatalf("session in use closed after %s, before its grace", time.Since(start))
+	case <-time.After(300 * time.Millisecond):
+	}
+	select {
+	case <-busy.done:
+	case <-time.After(time.Second):
+		t.Fatal("session in use still up past its grace")
+	}
+}
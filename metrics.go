@@ -0,0 +1,20 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"runtime"
+)
+
+// serveMetrics serves expvar metrics on addr, none when it is empty.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	go func() {
+		log.Println("metrics:", addr)
+		log.Println(http.ListenAndServe(addr, nil))
+	}()
+}
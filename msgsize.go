@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxMessageSize is -max-message-size, the largest data channel message
+// this peer receives, advertised to the other as a=max-message-size in
+// its SDP (RFC 8841). pions/webrtc v1.2.0 advertises none itself.
+var maxMessageSize = maxMessage
+
+// defaultMessageSize is what RFC 8841 assumes of a peer advertising no
+// max-message-size.
+const defaultMessageSize = 65536
+
+// minMessageSize is the least message size used, whatever a peer
+// advertises.
+const minMessageSize = 1024
+
+const messageSizeAttr = "a=max-message-size:"
+
+func checkMessageSize() error {
+	if maxMessageSize < minMessageSize || maxMessageSize > maxMessage {
+		return fmt.Errorf("-max-message-size must be between %d and %d", minMessageSize, maxMessage)
+	}
+	return nil
+}
+
+// advertiseMessageSize adds a=max-message-size to the application media
+// section of sdp.
+func advertiseMessageSize(sdp string) string {
+	lines := strings.Split(sdp, "\r\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "m=application") {
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && !strings.HasPrefix(lines[end], "m=") && lines[end] != "" {
+			end++
+		}
+		attr := messageSizeAttr + strconv.Itoa(maxMessageSize)
+		lines = append(lines[:end], append([]string{attr}, lines[end:]...)...)
+		break
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// remoteMessageSize returns the max-message-size the peer advertised in
+// sdp; 0 there means no limit.
+func remoteMessageSize(sdp string) int {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if !strings.HasPrefix(line, messageSizeAttr) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, messageSizeAttr)))
+		if err != nil || n < 0 {
+			break
+		}
+		if n == 0 {
+			return maxMessageSize
+		}
+		return n
+	}
+	return defaultMessageSize
+}
+
+// negotiateMessageSize sets the message size s sends: the smaller of what
+// both peers receive, but at least minMessageSize.
+func (s *session) negotiateMessageSize(remote string) {
+	r := remoteMessageSize(remote)
+	n := maxMessageSize
+	if r < n {
+		n = r
+	}
+	if n < minMessageSize {
+		n = minMessageSize
+	}
+	s.mu.Lock()
+	s.msgSize = n
+	s.mu.Unlock()
+	s.logf("session %s max message size %d (local %d, remote %d)", s.id, n, maxMessageSize, r)
+}
+
+// messageSize returns the negotiated message size of s.
+func (s *session) messageSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.msgSize <= 0 {
+		return maxMessageSize
+	}
+	return s.msgSize
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nobonobo/ssh-p2p/signaling"
+)
+
+func TestNegotiateMessageSize(t *testing.T) {
+	old := maxMessageSize
+	maxMessageSize = 8192
+	t.Cleanup(func() { maxMessageSize = old })
+	sdp := func(attr string) string {
+		return "v=0\r\nm=application 9 DTLS/SCTP 5000\r\n" + attr + "\r\n"
+	}
+	for _, c := range []struct {
+		name, sdp string
+		want      int
+	}{
+		{"smaller remote", sdp("a=max-message-size:2048"), 2048},
+		{"larger remote", sdp("a=max-message-size:65536"), 8192},
+		{"no limit", sdp("a=max-message-size:0"), 8192},
+		{"absent", sdp(""), 8192},
+		{"below minimum", sdp("a=max-message-size:100"), minMessageSize},
+		{"malformed", sdp("a=max-message-size:big"), 8192},
+	} {
+		s := &session{id: c.name}
+		s.negotiateMessageSize(c.sdp)
+		if got := s.messageSize(); got != c.want {
+			t.Errorf("%s: message size %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+// withTap captures forwarded bytes to a file, returning its path.
+func withTap(t *testing.T) string {
+	t.Helper()
+	old := capture
+	capture = &tap{path: filepath.Join(t.TempDir(), "tap")}
+	if err := capture.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		capture.f.Close()
+		capture = old
+	})
+	return capture.path
+}
+
+// advertise rewrites the max-message-size of every SDP pushed through h
+// to size, as if both peers ran with -max-message-size size.
+func advertise(h http.Handler, size int) http.Handler {
+	from := []byte(messageSizeAttr + strconv.Itoa(maxMessageSize))
+	to := []byte(messageSizeAttr + strconv.Itoa(size))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b = bytes.Replace(b, from, to, -1)
+		r.Body, r.ContentLength = ioutil.NopCloser(bytes.NewReader(b)), int64(len(b))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TestMismatchedMessageSize tunnels data to a peer advertising a smaller
+// max-message-size than this one's, and checks every message sent, read
+// back from the tap, fits the smaller size.
+func TestMismatchedMessageSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets up real peer connections")
+	}
+	eachRole(t, func(t *testing.T) {
+		const small = 2048
+		path := withTap(t)
+		withSignaling(t, advertise((&signaling.Server{}).Handler(), small))
+		key := room(uuid.New().String())
+		startServer(t, key, echoServer(t, nil))
+		conn := dialTunnel(t, key)
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+		want := make([]byte, 32<<10)
+		rand.New(rand.NewSource(*testSeed)).Read(want)
+		go conn.Write(want)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("echo differs: %s", firstDiff(got, want))
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var max, total int
+		for len(b) >= 17 {
+			dir, n := b[12], int(binary.BigEndian.Uint32(b[13:]))
+			if dir == tapRecv {
+				if n > max {
+					max = n
+				}
+				total += n
+			}
+			b = b[17+n:]
+		}
+		if total != 2*len(want) {
+			t.Fatalf("tap received %d bytes, want %d", total, 2*len(want))
+		}
+		if max != small {
+			t.Fatalf("largest message %d bytes, want %d", max, small)
+		}
+	})
+}
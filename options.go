@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"expvar"
+	"flag"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	metricsAddr  string
+	identityFile string
+	tcpNoDelay   = true
+	tcpKeepAlive = 15 * time.Second
+)
+
+// peerFlags registers the options shared by server and client.
+func peerFlags(flags *flag.FlagSet, key *string) {
+	flags.StringVar(key, "key", "sample", "connection key")
+	psk = key
+	flags.BoolVar(&aeadRequired, "aead", false, "client: also encrypt tunneled data with "+aeadName+" keyed by -key; server: refuse clients without it")
+	vaultFlags(flags, key)
+	flags.StringVar(&signalingURL, "signaling", signalingURL, "signaling server URL")
+	flags.StringVar(&signalingCA, "signaling-ca", "", "trust only this CA bundle for signaling (re-read when it changes)")
+	flags.DurationVar(&pushWait, "push-wait", pushWait, "retry a signaling push nobody pulls for this long, e.g. while a standby server starts")
+	flags.StringVar(&signalingIP, "signaling-ip", "", "connect to the signaling host at this IP (the certificate is still checked against the URL's host name)")
+	flags.DurationVar(&signalingCache, "signaling-cache", 0, "resolve the signaling host at startup and again after this long, keeping the last addresses when DNS fails (0 = on every connection)")
+	flags.DurationVar(&maxLifetime, "max-lifetime", 0, "force close connections after this duration (0 = unlimited)")
+	flags.DurationVar(&maxLifetimeGrace, "max-lifetime-grace", maxLifetimeGrace, "after -max-lifetime, let a connection in use end by itself for this long before closing it")
+	flags.StringVar(&recordFile, "record-signaling", "", "append the signaling messages sent and received to this file, for replay-signaling")
+	flags.BoolVar(&recordRedact, "record-redact", recordRedact, "mask addresses, ICE credentials, fingerprints, salts, signatures and names in -record-signaling")
+	flags.StringVar(&identityFile, "identity", "", "ed25519 identity key file (created if missing)")
+	tapFlags(flags)
+	flags.StringVar(&iceDiscoveryURL, "ice-discovery-url", "", "fetch ICE servers from URL (JSON iceServers + ttl)")
+	flags.StringVar(&controlSocket, "control-socket", "", "serve control commands on this unix socket")
+	flags.BoolVar(&plainKey, "plain-key", false, "send the key as is to signaling (compatible with older peers)")
+	flags.BoolVar(&tcpNoDelay, "tcp-nodelay", tcpNoDelay, "disable Nagle on tunneled TCP sockets")
+	flags.DurationVar(&tcpKeepAlive, "tcp-keepalive", tcpKeepAlive, "TCP keepalive period on tunneled sockets (0 = off)")
+	flags.DurationVar(&writeTimeout, "write-timeout", 0, "close a session whose data channel or local writes make no progress for this long (0 = never)")
+	flags.Int64Var(&maxSDPSize, "max-sdp-size", maxSDPSize, "reject SDPs from signaling larger than this many bytes")
+	flags.IntVar(&maxMessageSize, "max-message-size", maxMessageSize, "largest data channel message to receive, advertised to the peer (at most 8192)")
+	flags.IntVar(&maxCandidates, "max-candidates", 0, "send at most this many ICE candidates, srflx before host (0 = all)")
+	flags.BoolVar(&showPublicIP, "show-public-ip", false, "log and report the public (srflx) addresses of both peers")
+	flags.DurationVar(&stallTimeout, "stall-timeout", 0, "act when a connected session received nothing, not even a keepalive, for this long (0 = off)")
+	flags.StringVar(&stallAction, "stall-action", stallAction, "on a stall: reconnect (drop the session) or exit")
+	flags.DurationVar(&iceDisconnectTimeout, "ice-disconnect-timeout", iceDisconnectTimeout, "fail a session that stays ICE disconnected this long (0 = at once)")
+	flags.Var(&quota.max, "max-bytes", "close all sessions and refuse new ones after tunneling this much in total, e.g. 10GiB (0 = unlimited)")
+	flags.Var(&quota.maxSent, "max-bytes-sent", "like -max-bytes, counting sent bytes only")
+	flags.Var(&quota.maxRecv, "max-bytes-received", "like -max-bytes, counting received bytes only")
+	flags.StringVar(&metricsAddr, "metrics", "", "serve expvar metrics on addr = host:port")
+	flags.IntVar(&retries.max, "retry-budget", 0, "back off hard after this many signaling and reconnect retries within -retry-window (0 = unlimited)")
+	flags.DurationVar(&retries.window, "retry-window", retries.window, "window of -retry-budget")
+	flags.DurationVar(&retries.backoff, "retry-backoff", retries.backoff, "extra wait per retry once -retry-budget is spent")
+	flags.IntVar(&maxConns, "max-conns", 0, "refuse new tunneled connections beyond this many at a time (0 = unlimited)")
+	logFlags(flags)
+}
+
+// setupPeer applies the shared options once flags are parsed.
+func setupPeer() {
+	if !stallActions[stallAction] {
+		fatalConfig("-stall-action must be reconnect or exit")
+	}
+	if err := checkMessageSize(); err != nil {
+		fatalConfig(err)
+	}
+	setupLog()
+	setupVault()
+	setupRecording()
+	setupSignalingCA()
+	setupSignalingDNS()
+	setupQuota()
+	setupPause()
+	setupTrace()
+	if metricsAddr != "" {
+		expvar.Publish("sessions", expvar.Func(func() interface{} { return sessionCount() }))
+		expvar.Publish("forward_sessions", expvar.Func(forwardSessions))
+	}
+	serveMetrics(metricsAddr)
+	loadIdentityFlag()
+	openTap()
+	startDiscovery()
+}
+
+func startDiscovery() {
+	if iceDiscoveryURL == "" {
+		return
+	}
+	discovery = &iceDiscovery{url: iceDiscoveryURL}
+	rtcConfiguration()
+}
+
+func loadIdentityFlag() {
+	if identityFile == "" {
+		return
+	}
+	key, err := loadIdentity(identityFile)
+	if err != nil {
+		fatalConfig(err)
+	}
+	identity = key
+	log.Println("identity:", fingerprint(key.Public().(ed25519.PublicKey)))
+}
+
+// tuneTCP applies -tcp-nodelay and -tcp-keepalive to a tunneled socket.
+func tuneTCP(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(tcpNoDelay)
+	tc.SetKeepAlive(tcpKeepAlive > 0)
+	if tcpKeepAlive > 0 {
+		tc.SetKeepAlivePeriod(tcpKeepAlive)
+	}
+}
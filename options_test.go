@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt reads an integer socket option of c.
+func sockopt(t *testing.T, c *net.TCPConn, level, opt int) int {
+	t.Helper()
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+// TestTuneTCP applies -tcp-nodelay and -tcp-keepalive to accepted
+// connections, as a forward does, and reads them back from the socket.
+func TestTuneTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	oldNoDelay, oldKeepAlive := tcpNoDelay, tcpKeepAlive
+	t.Cleanup(func() { tcpNoDelay, tcpKeepAlive = oldNoDelay, oldKeepAlive })
+	for _, c := range []struct {
+		noDelay   bool
+		keepAlive time.Duration
+	}{
+		{true, 15 * time.Second},
+		{false, 40 * time.Second},
+		{true, 0},
+	} {
+		tcpNoDelay, tcpKeepAlive = c.noDelay, c.keepAlive
+		d, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		tuneTCP(conn)
+		tc := conn.(*net.TCPConn)
+		if got := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; got != c.noDelay {
+			t.Errorf("-tcp-nodelay=%t: TCP_NODELAY %t", c.noDelay, got)
+		}
+		keepAlive := sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+		if keepAlive != (c.keepAlive > 0) {
+			t.Errorf("-tcp-keepalive=%s: SO_KEEPALIVE %t", c.keepAlive, keepAlive)
+		}
+		if c.keepAlive == 0 {
+			continue
+		}
+		if got, want := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE), int(c.keepAlive/time.Second); got != want {
+			t.Errorf("-tcp-keepalive=%s: TCP_KEEPIDLE %ds, want %ds", c.keepAlive, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// pause is set by the pause and resume commands, or SIGUSR1 and SIGUSR2,
+// for backend maintenance: new tunnels are refused while the sessions up
+// stay connected. Quiesced, those also stop relaying local data until
+// resumed.
+var pause pauseState
+
+type pauseState struct {
+	mu      sync.Mutex
+	paused  bool
+	quiesce bool
+	since   time.Time
+	resumed chan struct{}
+}
+
+// pauseStatus is the pause section of the status command and metrics.
+type pauseStatus struct {
+	Paused  bool       `json:"paused"`
+	Quiesce bool       `json:"quiesce,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// setupPause adds the pause and resume commands, signals and status.
+func setupPause() {
+	controlCommands["pause"] = func(args []string) (interface{}, error) {
+		switch {
+		case len(args) == 0:
+			pause.set(false)
+		case len(args) == 1 && args[0] == "quiesce":
+			pause.set(true)
+		default:
+			return nil, fmt.Errorf("usage: pause [quiesce]")
+		}
+		return pause.status(), nil
+	}
+	controlCommands["resume"] = func(args []string) (interface{}, error) {
+		pause.resume()
+		return pause.status(), nil
+	}
+	statusFuncs["pause"] = func() interface{} { return pause.status() }
+	expvar.Publish("pause", expvar.Func(func() interface{} { return pause.status() }))
+	pauseSignals()
+}
+
+// set pauses, quiescing sessions too when quiesce is set.
+func (p *pauseState) set(quiesce bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		p.paused, p.since, p.resumed = true, time.Now(), make(chan struct{})
+	}
+	p.quiesce = quiesce
+	if quiesce {
+		log.Println("paused: refusing new tunnels, holding data of open sessions")
+	} else {
+		log.Println("paused: refusing new tunnels")
+	}
+}
+
+func (p *pauseState) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	log.Printf("resumed after %s", time.Since(p.since).Round(time.Second))
+	p.paused, p.quiesce = false, false
+	close(p.resumed)
+}
+
+// refusing reports whether new tunnels are refused.
+func (p *pauseState) refusing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// hold blocks while quiesced, until resumed or done is closed, and then
+// fails.
+func (p *pauseState) hold(done <-chan struct{}) error {
+	p.mu.Lock()
+	quiesce, resumed := p.quiesce, p.resumed
+	p.mu.Unlock()
+	if !quiesce {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (p *pauseState) status() pauseStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return pauseStatus{}
+	}
+	since := p.since
+	return pauseStatus{Paused: true, Quiesce: p.quiesce, Since: &since}
+}
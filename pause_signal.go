@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// pauseSignals pauses on SIGUSR1 and resumes on SIGUSR2.
+func pauseSignals() {
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range usr {
+			if sig == syscall.SIGUSR1 {
+				pause.set(false)
+			} else {
+				pause.resume()
+			}
+		}
+	}()
+}
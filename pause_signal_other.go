@@ -0,0 +1,8 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+// There is no SIGUSR1 or SIGUSR2 here; pause and resume are ctl commands
+// only.
+func pauseSignals() {}
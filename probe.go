@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pions/pkg/stun"
+	"github.com/pions/webrtc/pkg/ice"
+)
+
+// iceProbe is the result of probing one ICE server over one network.
+type iceProbe struct {
+	URL     string        `json:"url"`
+	Network string        `json:"network"`
+	RTT     time.Duration `json:"-"`
+	RTTMs   float64       `json:"rtt_ms,omitempty"`
+	Mapped  string        `json:"mapped,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// probeICE sends a STUN binding request to every configured ICE server over
+// udp4 and udp6 and prints the results, fastest first. It fails when no
+// server answered.
+func probeICE(timeout time.Duration, asJSON bool) error {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []iceProbe
+	)
+	add := func(p iceProbe) {
+		mu.Lock()
+		results = append(results, p)
+		mu.Unlock()
+	}
+	for _, server := range rtcConfiguration().IceServers {
+		for _, raw := range server.URLs {
+			u, err := ice.ParseURL(raw)
+			if err != nil {
+				add(iceProbe{URL: raw, Error: err.Error()})
+				continue
+			}
+			if u.Scheme != ice.SchemeTypeSTUN {
+				add(iceProbe{URL: raw, Error: u.Scheme.String() + " is not supported by pions/webrtc v1.2.0"})
+				continue
+			}
+			for _, network := range []string{"udp4", "udp6"} {
+				wg.Add(1)
+				go func(raw, network, addr string) {
+					defer wg.Done()
+					add(probeSTUN(raw, network, addr, timeout))
+				}(raw, network, net.JoinHostPort(u.Host, strconv.Itoa(u.Port)))
+			}
+		}
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.Error == "") != (b.Error == "") {
+			return a.Error == ""
+		}
+		return a.RTT < b.RTT
+	})
+	if asJSON {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, p := range results {
+			if p.Error != "" {
+				fmt.Printf("%10s  %s %s  %s\n", "failed", p.URL, p.Network, p.Error)
+				continue
+			}
+			fmt.Printf("%10s  %s %s  %s\n", p.RTT.Round(100*time.Microsecond), p.URL, p.Network, p.Mapped)
+		}
+	}
+	if len(results) == 0 || results[0].Error != "" {
+		return fmt.Errorf("%w: no ICE server answered", errICEFailed)
+	}
+	return nil
+}
+
+func probeSTUN(url, network, addr string, timeout time.Duration) iceProbe {
+	p := iceProbe{URL: url, Network: network}
+	start := time.Now()
+	client, err := stun.NewClient(network, addr, timeout)
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	defer client.Close()
+	res, err := client.Request()
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	p.RTT = time.Since(start)
+	p.RTTMs = float64(p.RTT) / float64(time.Millisecond)
+	if attr, ok := res.GetOneAttribute(stun.AttrXORMappedAddress); ok {
+		var mapped stun.XorAddress
+		if err := mapped.Unpack(res, attr); err == nil {
+			p.Mapped = net.JoinHostPort(mapped.IP.String(), strconv.Itoa(mapped.Port))
+		}
+	}
+	return p
+}
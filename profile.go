@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// profileVersion is the version of the profile file format.
+const profileVersion = 1
+
+// profile is a shareable sub-command invocation:
+//
+//	{"version": 1, "command": "client", "args": ["-key=${SSH_P2P_KEY}", "-forward=5432:db"]}
+//
+// Secrets are stored as ${VAR} references resolved from the environment on
+// import unless exported with -include-secrets.
+type profile struct {
+	Version int      `json:"version"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// profileSecrets maps secret flags to the variables that stand in for them.
+var profileSecrets = map[string]string{
+	"key":   "SSH_P2P_KEY",
+	"token": "SSH_P2P_TOKEN",
+}
+
+// exporting is set by export-profile: the sub-command prints its profile
+// once flags are parsed instead of running.
+var exporting struct {
+	on      bool
+	secrets bool
+}
+
+// exportProfileArgs handles "export-profile [-include-secrets] SUBCMD ARGS",
+// returning the arguments to run SUBCMD with.
+func exportProfileArgs(args []string) []string {
+	flags := flag.NewFlagSet("export-profile", flag.ExitOnError)
+	flags.BoolVar(&exporting.secrets, "include-secrets", false, "write secrets as is instead of ${VAR} references")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fatalConfig("usage: ssh-p2p export-profile [-include-secrets] SUBCMD [options]")
+	}
+	exporting.on = true
+	return flags.Args()
+}
+
+// exportProfile prints the profile of cmd when exporting and exits.
+func exportProfile(cmd string, flags *flag.FlagSet, args []string) {
+	if !exporting.on {
+		return
+	}
+	p := profile{Version: profileVersion, Command: cmd, Args: []string{}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			p.Args = append(p.Args, args[i:]...)
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		f := flags.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			if !hasValue {
+				value = "true"
+			}
+		} else if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if v, ok := profileSecrets[name]; ok && !exporting.secrets {
+			value = "${" + v + "}"
+		}
+		p.Args = append(p.Args, "-"+name+"="+value)
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		fatalConfig(err)
+	}
+	fmt.Println(string(b))
+	os.Exit(0)
+}
+
+// importProfileArgs reads the profile in args[0], returning the sub-command
+// and its arguments followed by the remaining args.
+func importProfileArgs(args []string) (string, []string) {
+	if len(args) == 0 {
+		fatalConfig("usage: ssh-p2p import-profile FILE [options]")
+	}
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		fatalConfig(err)
+	}
+	var p profile
+	if err := json.Unmarshal(b, &p); err != nil {
+		fatalConfig(args[0]+":", err)
+	}
+	if p.Version != profileVersion {
+		fatalConfig(fmt.Sprintf("%s: unsupported profile version %d (want %d)", args[0], p.Version, profileVersion))
+	}
+	var missing []string
+	expand := func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	}
+	var out []string
+	for _, arg := range p.Args {
+		out = append(out, os.Expand(arg, expand))
+	}
+	if len(missing) > 0 {
+		fatalConfig(args[0]+": profile needs", strings.Join(missing, ", "))
+	}
+	return p.Command, append(out, args[1:]...)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyProtocol is the PROXY protocol version ("v1" or "v2") the server
+// sends to dialed destinations, or empty for none.
+var proxyProtocol string
+
+// acceptProxyProtocol is the client's -accept-proxy-protocol: local
+// connections start with a PROXY protocol header (v1 or v2), which is
+// stripped and its source address passed on to the server.
+var acceptProxyProtocol bool
+
+// proxyHeaderTimeout bounds reading the header of an accepted connection.
+var proxyHeaderTimeout = 5 * time.Second
+
+// proxySignature starts every PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader builds the PROXY protocol header of version for a connection
+// from src to dst. A nil address, or mixed families in v1, yields the
+// header for an unknown source.
+func proxyHeader(version string, src, dst *net.TCPAddr) ([]byte, error) {
+	switch version {
+	case "v1":
+		return proxyHeaderV1(src, dst), nil
+	case "v2":
+		return proxyHeaderV2(src, dst), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q (want v1 or v2)", version)
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto, sip, dip := "TCP4", src.IP.To4(), dst.IP.To4()
+	if sip == nil {
+		proto, sip, dip = "TCP6", src.IP.To16(), dst.IP.To16()
+	}
+	return []byte("PROXY " + proto + " " + sip.String() + " " + dip.String() + " " +
+		strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	var b bytes.Buffer
+	b.Write(proxySignature)
+	if src == nil || dst == nil {
+		// PROXY command, AF_UNSPEC: the receiver keeps the real addresses.
+		b.Write([]byte{0x21, 0x00, 0, 0})
+		return b.Bytes()
+	}
+	family, sip, dip := byte(0x11), src.IP.To4(), dst.IP.To4()
+	if sip == nil || dip == nil {
+		family, sip, dip = 0x21, src.IP.To16(), dst.IP.To16()
+	}
+	b.Write([]byte{0x21, family})
+	binary.Write(&b, binary.BigEndian, uint16(2*len(sip)+4))
+	b.Write(sip)
+	b.Write(dip)
+	binary.Write(&b, binary.BigEndian, uint16(src.Port))
+	binary.Write(&b, binary.BigEndian, uint16(dst.Port))
+	return b.Bytes()
+}
+
+// proxied marks s to send the -proxy-protocol header to its destination
+// once the data channel opens.
+func (s *session) proxied() {
+	s.mu.Lock()
+	s.proxy = proxyProtocol != ""
+	s.mu.Unlock()
+}
+
+// writeProxyHeader sends the -proxy-protocol header on conn, with the
+// client's origin, or else its candidate address, as source and the
+// dialed address as destination, before anything else is written to
+// conn. It does nothing without -proxy-protocol or for the embedded ssh
+// server.
+func (s *session) writeProxyHeader(conn net.Conn) error {
+	s.header.Do(func() { s.headerErr = s.sendProxyHeader(conn) })
+	return s.headerErr
+}
+
+func (s *session) sendProxyHeader(conn net.Conn) error {
+	s.mu.Lock()
+	send, addr := s.proxy, s.addr
+	if s.origin != "" {
+		addr = s.origin
+	}
+	s.mu.Unlock()
+	if !send {
+		return nil
+	}
+	dst, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	var src *net.TCPAddr
+	if addr != "" {
+		src, _ = net.ResolveTCPAddr("tcp", addr)
+	}
+	b, err := proxyHeader(proxyProtocol, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// acceptProxy strips the PROXY protocol header from a local connection
+// under -accept-proxy-protocol; conn's RemoteAddr then is the source it
+// names. Connections without a valid header are refused.
+func acceptProxy(conn net.Conn) (net.Conn, error) {
+	if !acceptProxyProtocol {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	r := bufio.NewReader(conn)
+	src, err := readProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	return &proxiedConn{Conn: conn, r: r, src: src}, nil
+}
+
+// readProxyHeader reads a v1 or v2 header from r, returning its source
+// address. It is nil for LOCAL (v2) and UNKNOWN (v1) headers, and for
+// other than TCP or UDP over IP, where the connection's own address
+// stands.
+func readProxyHeader(r *bufio.Reader) (*net.TCPAddr, error) {
+	b, err := r.Peek(len(proxySignature))
+	if err == nil && bytes.Equal(b, proxySignature) {
+		return readProxyHeaderV2(r)
+	}
+	if b, err := r.Peek(6); err == nil && string(b) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return nil, errNoProxyHeader
+}
+
+// maxProxyHeaderV1 is the longest v1 header line, CRLF included.
+const maxProxyHeaderV1 = 107
+
+func readProxyHeaderV1(r *bufio.Reader) (*net.TCPAddr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyHeaderV1 {
+			return nil, fmt.Errorf("%w: v1 header longer than %d bytes", errNoProxyHeader, maxProxyHeaderV1)
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	f := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: bad v1 header %q", errNoProxyHeader, line)
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || (ip.To4() != nil) != (f[1] == "TCP4") || err != nil || port < 0 || port > 65535 || net.ParseIP(f[3]) == nil {
+		return nil, fmt.Errorf("%w: bad v1 header %q", errNoProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*net.TCPAddr, error) {
+	head := make([]byte, len(proxySignature)+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	verCmd, family := head[12], head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 || verCmd&0xf > 1 {
+		return nil, fmt.Errorf("%w: bad v2 version or command %#x", errNoProxyHeader, verCmd)
+	}
+	if verCmd&0xf == 0 {
+		// LOCAL: the proxy's own connection, e.g. a health check.
+		return nil, nil
+	}
+	var size int
+	switch family >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, fmt.Errorf("%w: v2 addresses of %d bytes", errNoProxyHeader, len(body))
+	}
+	ip := net.IP(append([]byte{}, body[:size]...))
+	port := int(binary.BigEndian.Uint16(body[2*size:]))
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// proxiedConn is a local connection after its PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	r   *bufio.Reader
+	src *net.TCPAddr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.src == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.src
+}
+
+// localOrigin returns the source address a client passes on to the
+// server for sock, under -accept-proxy-protocol only.
+func localOrigin(sock net.Conn) string {
+	if !acceptProxyProtocol {
+		return ""
+	}
+	if a, ok := sock.RemoteAddr().(*net.TCPAddr); ok {
+		return a.String()
+	}
+	return ""
+}
+
+// setOrigin records the address the tunneled connection came from: on
+// the client to pass on, on the server as the source of the
+// -proxy-protocol header.
+func (s *session) setOrigin(origin string) {
+	if origin == "" {
+		return
+	}
+	host, port, err := net.SplitHostPort(origin)
+	if err != nil || net.ParseIP(host) == nil {
+		s.logf("session %s: ignoring invalid origin %q", s.id, origin)
+		return
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		s.logf("session %s: ignoring invalid origin %q", s.id, origin)
+		return
+	}
+	s.mu.Lock()
+	s.origin = origin
+	s.mu.Unlock()
+	s.logf("session %s origin: %s", s.id, origin)
+}
+
+func (s *session) originAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.origin
+}
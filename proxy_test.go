@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+// TestProxyHeader checks built headers against the examples of the
+// PROXY protocol specification, byte for byte.
+func TestProxyHeader(t *testing.T) {
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+	for _, c := range []struct {
+		name, version string
+		src, dst      *net.TCPAddr
+		want          string
+	}{
+		{"v1 TCP4", "v1", tcpAddr("192.0.2.1", 40000), tcpAddr("192.0.2.2", 22),
+			"PROXY TCP4 192.0.2.1 192.0.2.2 40000 22\r\n"},
+		{"v1 TCP6", "v1", tcpAddr("2001:db8::1", 40000), tcpAddr("2001:db8::2", 22),
+			"PROXY TCP6 2001:db8::1 2001:db8::2 40000 22\r\n"},
+		{"v1 UNKNOWN", "v1", nil, tcpAddr("192.0.2.2", 22),
+			"PROXY UNKNOWN\r\n"},
+		{"v1 mixed families", "v1", tcpAddr("192.0.2.1", 40000), tcpAddr("2001:db8::2", 22),
+			"PROXY UNKNOWN\r\n"},
+		{"v2 TCP4", "v2", tcpAddr("192.0.2.1", 40000), tcpAddr("192.0.2.2", 22),
+			sig + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc0\x00\x02\x02" + "\x9c\x40" + "\x00\x16"},
+		{"v2 TCP6", "v2", tcpAddr("2001:db8::1", 40000), tcpAddr("2001:db8::2", 22),
+			sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x9c\x40" + "\x00\x16"},
+		{"v2 mixed families", "v2", tcpAddr("192.0.2.1", 40000), tcpAddr("2001:db8::2", 22),
+			sig + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xc0\x00\x02\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x9c\x40" + "\x00\x16"},
+		{"v2 UNKNOWN", "v2", nil, nil,
+			sig + "\x21\x00\x00\x00"},
+	} {
+		got, err := proxyHeader(c.version, c.src, c.dst)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if string(got) != c.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", c.name, got, c.want)
+		}
+	}
+	if _, err := proxyHeader("v3", nil, nil); err == nil {
+		t.Error("v3 header built")
+	}
+}
+
+func TestReadProxyHeaderTruncated(t *testing.T) {
+	v2 := proxyHeaderV2(tcpAddr("192.0.2.1", 40000), tcpAddr("192.0.2.2", 22))
+	for name, b := range map[string][]byte{
+		"v1 without CRLF": []byte("PROXY TCP4 192.0.2.1 192.0.2.2 40000 22"),
+		"v2 signature":    v2[:len(proxySignature)+2],
+		"v2 addresses":    v2[:len(v2)-3],
+	} {
+		if _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(b))); err == nil {
+			t.Errorf("%s: truncated header read", name)
+		}
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	withAcceptProxyProtocol(t)
+	for _, c := range []struct {
+		name   string
+		header []byte
+		src    string // empty for the connection's own address
+	}{
+		{"v1", proxyHeaderV1(tcpAddr("192.0.2.1", 40000), tcpAddr("192.0.2.2", 22)), "192.0.2.1:40000"},
+		{"v2", proxyHeaderV2(tcpAddr("2001:db8::1", 40000), tcpAddr("2001:db8::2", 22)), "[2001:db8::1]:40000"},
+		{"v2 LOCAL", append(append([]byte{}, proxySignature...), 0x20, 0x00, 0x00, 0x00), ""},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), ""},
+	} {
+		c := c
+		local, remote := net.Pipe()
+		go func() {
+			remote.Write(append(c.header, "SSH-2.0-x\r\n"...))
+			remote.Close()
+		}()
+		conn, err := acceptProxy(local)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			local.Close()
+			continue
+		}
+		want := c.src
+		if want == "" {
+			want = local.RemoteAddr().String()
+		}
+		if got := conn.RemoteAddr().String(); got != want {
+			t.Errorf("%s: source %s, want %s", c.name, got, want)
+		}
+		if b, _ := ioutil.ReadAll(conn); string(b) != "SSH-2.0-x\r\n" {
+			t.Errorf("%s: data after the header %q", c.name, b)
+		}
+		conn.Close()
+	}
+}
+
+func TestAcceptProxySlowClient(t *testing.T) {
+	withAcceptProxyProtocol(t)
+	old := proxyHeaderTimeout
+	proxyHeaderTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { proxyHeaderTimeout = old })
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	// the header starts, then stalls
+	go remote.Write([]byte("PROXY TCP4 "))
+	start := time.Now()
+	_, err := acceptProxy(local)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("took %s to time out", d)
+	}
+}
+
+func FuzzReadProxyHeader(f *testing.F) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 22}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 22}
+	f.Add(proxyHeaderV1(src, dst))
+	f.Add(proxyHeaderV1(src6, dst6))
+	f.Add(proxyHeaderV1(nil, nil))
+	f.Add(proxyHeaderV2(src, dst))
+	f.Add(proxyHeaderV2(src6, dst6))
+	f.Add(proxyHeaderV2(nil, nil))
+	f.Add([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	f.Add([]byte("PROXY TCP4 192.0.2.1\r\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bufio.NewReader(bytes.NewReader(b))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			return
+		}
+		if addr != nil && (addr.IP == nil || addr.Port < 0 || addr.Port > 0xffff) {
+			t.Fatalf("%q: source %v", b, addr)
+		}
+		if rest := r.Buffered(); bytes.HasPrefix(b, []byte("PROXY ")) && len(b)-rest > maxProxyHeaderV1 {
+			t.Fatalf("%q: v1 header of %d bytes", b, len(b)-rest)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// byteSize is a flag.Value for byte counts such as "10GiB", "500MB" or
+// "1.5GiB"; fractions round down to whole bytes.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, unit := s, int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			n, unit = strings.TrimSuffix(s, u.suffix), u.n
+			break
+		}
+	}
+	n = strings.TrimSpace(n)
+	v, ok := new(big.Rat).SetString(n)
+	if !ok || !isDecimal(n) {
+		return fmt.Errorf("invalid size %q (e.g. 10GiB, 500MB, 1.5GiB)", s)
+	}
+	v.Mul(v, new(big.Rat).SetInt64(unit))
+	whole := new(big.Int).Quo(v.Num(), v.Denom())
+	if !whole.IsInt64() {
+		return fmt.Errorf("size %q too large (max %d bytes)", s, int64(math.MaxInt64))
+	}
+	*b = byteSize(whole.Int64())
+	return nil
+}
+
+// isDecimal reports whether s is digits with at most one decimal point.
+func isDecimal(s string) bool {
+	digits, points := 0, 0
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.':
+			points++
+		default:
+			return false
+		}
+	}
+	return digits > 0 && points <= 1
+}
+
+// errQuota refuses new sessions once the byte quota is used up.
+var errQuota = errors.New("byte quota reached")
+
+// quota caps the bytes tunneled over all sessions. Zero limits are off.
+var quota byteQuota
+
+type byteQuota struct {
+	max, maxSent, maxRecv byteSize
+
+	sent, recv int64 // atomic
+	once       sync.Once
+}
+
+// quotaStatus is the status and metrics view of the quota; remaining
+// counts are set for the configured limits.
+type quotaStatus struct {
+	Sent          int64  `json:"sent"`
+	Received      int64  `json:"received"`
+	Remaining     *int64 `json:"remaining,omitempty"`
+	RemainingSent *int64 `json:"remaining_sent,omitempty"`
+	RemainingRecv *int64 `json:"remaining_received,omitempty"`
+}
+
+func (q *byteQuota) enabled() bool {
+	return q.max > 0 || q.maxSent > 0 || q.maxRecv > 0
+}
+
+// setupQuota publishes the quota in the status command and metrics.
+func setupQuota() {
+	if !quota.enabled() {
+		return
+	}
+	statusFuncs["quota"] = func() interface{} { return quota.status() }
+	expvar.Publish("quota", expvar.Func(func() interface{} { return quota.status() }))
+}
+
+// add counts tunneled bytes, closing every session when a limit is hit.
+func (q *byteQuota) add(sent, recv int) {
+	if !q.enabled() {
+		return
+	}
+	atomic.AddInt64(&q.sent, int64(sent))
+	atomic.AddInt64(&q.recv, int64(recv))
+	if q.exceeded() {
+		q.once.Do(func() {
+			s := q.status()
+			log.Printf("%v: sent %d, received %d bytes; closing all sessions", errQuota, s.Sent, s.Received)
+			go closeSessions()
+		})
+	}
+}
+
+func (q *byteQuota) exceeded() bool {
+	sent, recv := atomic.LoadInt64(&q.sent), atomic.LoadInt64(&q.recv)
+	return (q.max > 0 && sent+recv >= int64(q.max)) ||
+		(q.maxSent > 0 && sent >= int64(q.maxSent)) ||
+		(q.maxRecv > 0 && recv >= int64(q.maxRecv))
+}
+
+func (q *byteQuota) status() quotaStatus {
+	s := quotaStatus{Sent: atomic.LoadInt64(&q.sent), Received: atomic.LoadInt64(&q.recv)}
+	left := func(max byteSize, used int64) *int64 {
+		if max <= 0 {
+			return nil
+		}
+		n := int64(max) - used
+		if n < 0 {
+			n = 0
+		}
+		return &n
+	}
+	s.Remaining = left(q.max, s.Sent+s.Received)
+	s.RemainingSent = left(q.maxSent, s.Sent)
+	s.RemainingRecv = left(q.maxRecv, s.Received)
+	return s
+}
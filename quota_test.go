@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestByteSizeSet(t *testing.T) {
+	for s, want := range map[string]int64{
+		"0":                    0,
+		"512":                  512,
+		"10GiB":                10 << 30,
+		"500MB":                500e6,
+		"1.5MiB":               3 << 19,
+		"1.5MB":                1500000,
+		".5KiB":                512,
+		"1.0001KiB":            1024, // rounds down to whole bytes
+		"8EiB":                 -1,
+		"9223372036854775807B": 1<<63 - 1,
+		"9223372036854775808":  -1,
+		"8388608TiB":           -1, // 2^63 bytes
+		"9223373TB":            -1,
+		"-1":                   -1,
+		"1.2.3MB":              -1,
+		"1e3":                  -1,
+		"0x10":                 -1,
+		"1/2GiB":               -1,
+		"MB":                   -1,
+		"":                     -1,
+	} {
+		var b byteSize
+		err := b.Set(s)
+		if want < 0 {
+			if err == nil {
+				t.Errorf("%q: got %d, want an error", s, b)
+			}
+			continue
+		}
+		if err != nil || int64(b) != want {
+			t.Errorf("%q: got %d, %v, want %d", s, b, err, want)
+		}
+	}
+}
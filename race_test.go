@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package main
+
+// raceEnabled is set when the tests run under the race detector.
+const raceEnabled = true
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	// reconnectMaxAttempts is -reconnect-max-attempts: once this many
+	// tunnels in a row failed to open, the client closes its listeners and
+	// exits with exitUnreachable (0 = keep listening).
+	reconnectMaxAttempts int
+	// reconnectFastFail is -reconnect-fast-fail: after a tunnel failed to
+	// open, local connections arriving while the next attempt is in
+	// progress are refused instead of each making an attempt of its own.
+	reconnectFastFail bool
+)
+
+// reconnects counts the tunnels failing in a row, until ICE connects.
+var reconnects struct {
+	mu     sync.Mutex
+	failed int
+	probe  int64 // the attempt in progress since the last failure, 0 = none
+	next   int64
+	giveUp func()
+}
+
+// startAttempt begins a tunnel attempt, returning the token for
+// endAttempt, or false with the failures so far when it is fast-failed.
+func startAttempt() (int64, int, bool) {
+	reconnects.mu.Lock()
+	defer reconnects.mu.Unlock()
+	reconnects.next++
+	token := reconnects.next
+	if !reconnectFastFail || reconnects.failed == 0 {
+		return token, 0, true
+	}
+	if reconnects.probe != 0 {
+		return 0, reconnects.failed, false
+	}
+	reconnects.probe = token
+	return token, 0, true
+}
+
+// endAttempt records how the attempt of token ended, err being why its
+// data channel did not open. Spending -reconnect-max-attempts gives up.
+func endAttempt(token int64, err error) {
+	reconnects.mu.Lock()
+	if reconnects.probe == token {
+		reconnects.probe = 0
+	}
+	if err == nil {
+		reconnects.mu.Unlock()
+		return
+	}
+	reconnects.failed++
+	failed, giveUp := reconnects.failed, reconnects.giveUp
+	reconnects.mu.Unlock()
+	if reconnectMaxAttempts <= 0 {
+		return
+	}
+	log.Printf("tunnel attempt %d of %d failed (-reconnect-max-attempts)", failed, reconnectMaxAttempts)
+	if failed >= reconnectMaxAttempts && giveUp != nil {
+		log.Printf("peer unreachable: %d tunnel attempts in a row failed, closing listeners", failed)
+		giveUp()
+		os.Exit(exitUnreachable)
+	}
+}
+
+// resetAttempts clears the failures once a peer connection came up.
+func resetAttempts() {
+	reconnects.mu.Lock()
+	reconnects.failed, reconnects.probe = 0, 0
+	reconnects.mu.Unlock()
+}
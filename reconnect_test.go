@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func withReconnects(t *testing.T, max int, fastFail bool) {
+	t.Helper()
+	oldMax, oldFast := reconnectMaxAttempts, reconnectFastFail
+	reconnectMaxAttempts, reconnectFastFail = max, fastFail
+	resetAttempts()
+	t.Cleanup(func() {
+		reconnectMaxAttempts, reconnectFastFail = oldMax, oldFast
+		resetAttempts()
+	})
+}
+
+func TestFastFailOneAttemptAtATime(t *testing.T) {
+	withReconnects(t, 0, true)
+	token, _, ok := startAttempt()
+	if !ok {
+		t.Fatal("first attempt refused")
+	}
+	endAttempt(token, errTimeout)
+	probe, _, ok := startAttempt()
+	if !ok {
+		t.Fatal("attempt after a failure refused")
+	}
+	if _, failed, ok := startAttempt(); ok || failed != 1 {
+		t.Fatalf("second attempt during the probe: ok %v, failed %d", ok, failed)
+	}
+	endAttempt(probe, errTimeout)
+	if _, _, ok := startAttempt(); !ok {
+		t.Fatal("attempt after the probe ended refused")
+	}
+	resetAttempts()
+	for i := 0; i < 3; i++ {
+		if _, _, ok := startAttempt(); !ok {
+			t.Fatal("attempt refused after ICE connected")
+		}
+	}
+}
+
+// TestGiveUpExits runs itself in a child process, which must close the
+// listeners and exit 7 on the second failure in a row.
+func TestGiveUpExits(t *testing.T) {
+	if os.Getenv("SSH_P2P_TEST_GIVE_UP") == "1" {
+		withReconnects(t, 2, false)
+		reconnects.giveUp = func() { fmt.Println("listeners closed") }
+		for i := 0; i < 2; i++ {
+			token, _, _ := startAttempt()
+			endAttempt(token, errTimeout)
+		}
+		t.Fatal("still running after -reconnect-max-attempts")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestGiveUpExits$")
+	cmd.Env = append(os.Environ(), "SSH_P2P_TEST_GIVE_UP=1")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitUnreachable {
+		t.Fatalf("got %v, want exit %d\n%s", err, exitUnreachable, out)
+	}
+	if !strings.Contains(string(out), "listeners closed") {
+		t.Fatalf("listeners not closed:\n%s", out)
+	}
+}
+
+func TestFastFailWarmConn(t *testing.T) {
+	withReconnects(t, 0, true)
+	token, _, _ := startAttempt()
+	endAttempt(token, errTimeout)
+	startAttempt()
+	f := &forward{listen: "127.0.0.1:0"}
+	// refused without a socket to log the address of
+	f.tunnel(context.Background(), "", newWarmConn())
+}
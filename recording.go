@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nobonobo/ssh-p2p/signaling"
+)
+
+var (
+	// recordFile is -record-signaling: append every signaling message
+	// sent and received to this file, for replay-signaling.
+	recordFile string
+	// recordRedact is -record-redact: mask addresses, ICE credentials,
+	// fingerprints, salts, signatures and names in the recording.
+	recordRedact = true
+)
+
+// recorder is the open -record-signaling file, nil when not recording.
+var recorder *signalRecorder
+
+// replay stands in for the signaling server in replay-signaling.
+var replay *signalReplay
+
+const (
+	recordFormat     = 1
+	recordSent       = "sent"
+	recordReceived   = "received"
+	recordRendezvous = "rendezvous"
+)
+
+// recordHeader is the first line of a recording.
+type recordHeader struct {
+	Recording int       `json:"recording"`
+	Role      string    `json:"role"`
+	Start     time.Time `json:"start"`
+	Version   int       `json:"version"`
+	Redacted  bool      `json:"redacted"`
+}
+
+// recordEntry is every further line: one message, At milliseconds after
+// Start. Room is rendezvous for the room of -key, which is not recorded,
+// or else the session id the message was addressed to.
+type recordEntry struct {
+	At   int64                 `json:"at_ms"`
+	Dir  string                `json:"dir"`
+	Room string                `json:"room"`
+	Info signaling.ConnectInfo `json:"info"`
+}
+
+type signalRecorder struct {
+	mu         sync.Mutex
+	f          *os.File
+	enc        *json.Encoder
+	start      time.Time
+	rendezvous string
+	redact     *redactor
+}
+
+// setupRecording opens -record-signaling, once -key is final.
+func setupRecording() {
+	if recordFile == "" {
+		return
+	}
+	f, err := os.OpenFile(recordFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fatalConfig(err)
+	}
+	r := &signalRecorder{f: f, enc: json.NewEncoder(f), start: time.Now(), rendezvous: room(*psk)}
+	if recordRedact {
+		r.redact = &redactor{addrs: map[string]string{}}
+	}
+	role := ""
+	if len(os.Args) > 1 {
+		role = os.Args[1]
+	}
+	if err := r.enc.Encode(recordHeader{Recording: recordFormat, Role: role, Start: r.start, Version: signaling.Version, Redacted: recordRedact}); err != nil {
+		fatalConfig(err)
+	}
+	recorder = r
+	log.Println("recording signaling to", recordFile)
+}
+
+// record appends info, sent to or received in room.
+func (r *signalRecorder) record(dir, room string, info signaling.ConnectInfo) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if room == r.rendezvous {
+		room = recordRendezvous
+	}
+	if r.redact != nil {
+		info = r.redact.info(info)
+	}
+	e := recordEntry{At: time.Since(r.start).Milliseconds(), Dir: dir, Room: room, Info: info}
+	if err := r.enc.Encode(e); err != nil {
+		log.Println("recording signaling:", err)
+	}
+}
+
+// redactor masks what a recording shared for debugging should not give
+// away. Each address becomes the same documentation address wherever it
+// appears, so candidates can still be matched up.
+type redactor struct {
+	addrs map[string]string
+	v4    int
+	v6    int
+}
+
+func (r *redactor) info(info signaling.ConnectInfo) signaling.ConnectInfo {
+	info.SDP = r.sdp(info.SDP)
+	info.PublicKey, info.Signature, info.Salt = nil, nil, nil
+	if info.Name != "" {
+		info.Name = "redacted"
+	}
+	if info.Origin != "" {
+		info.Origin = "redacted"
+	}
+	return info
+}
+
+func (r *redactor) sdp(sdp string) string {
+	if sdp == "" {
+		return sdp
+	}
+	lines := strings.Split(sdp, "\r\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "a=ice-pwd:"), strings.HasPrefix(line, "a=ice-ufrag:"):
+			k := strings.Index(line, ":") + 1
+			lines[i] = line[:k] + strings.Repeat("x", len(line)-k)
+		case strings.HasPrefix(line, "a=fingerprint:"):
+			f := strings.Fields(line)
+			if len(f) == 2 {
+				f[1] = strings.Map(func(c rune) rune {
+					if c == ':' {
+						return c
+					}
+					return '0'
+				}, f[1])
+			}
+			lines[i] = strings.Join(f, " ")
+		default:
+			f := strings.Split(line, " ")
+			for j, tok := range f {
+				f[j] = r.addr(tok)
+			}
+			lines[i] = strings.Join(f, " ")
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// addr maps an IP address token to a documentation address, leaving
+// other tokens and unspecified or loopback addresses as they are.
+func (r *redactor) addr(tok string) string {
+	ip := net.ParseIP(tok)
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return tok
+	}
+	if m, ok := r.addrs[tok]; ok {
+		return m
+	}
+	var m string
+	if ip.To4() != nil {
+		r.v4++
+		m = fmt.Sprintf("192.0.2.%d", r.v4%254+1)
+	} else {
+		r.v6++
+		m = fmt.Sprintf("2001:db8::%x", r.v6)
+	}
+	r.addrs[tok] = m
+	return m
+}
+
+// signalReplay plays back the messages a recording received from its peer
+// to a fresh session, at the recorded pace relative to the messages this
+// side sends.
+type signalReplay struct {
+	mu         sync.Mutex
+	changed    chan struct{}
+	header     recordHeader
+	rendezvous string
+	speed      float64
+	start      time.Time
+	received   []replayEntry
+	sent       []recordEntry
+	sentAt     []time.Time
+}
+
+// replayEntry is a received message due gap after the after'th message
+// this side sent, or after the start when that is 0.
+type replayEntry struct {
+	recordEntry
+	after int
+	gap   time.Duration
+	taken bool
+}
+
+// loadReplay reads a recording, keeping the first session in it: the
+// messages from the first peer heard from and those this side sent it.
+func loadReplay(file string, speed float64) (*signalReplay, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, int(signaling.MaxBodySize(maxSDPSize))*2)
+	r := &signalReplay{changed: make(chan struct{}), speed: speed}
+	if !sc.Scan() {
+		return nil, fmt.Errorf("%s: empty recording", file)
+	}
+	if err := json.Unmarshal(sc.Bytes(), &r.header); err != nil || r.header.Recording == 0 {
+		return nil, fmt.Errorf("%s: not a signaling recording", file)
+	}
+	if r.header.Recording > recordFormat {
+		return nil, fmt.Errorf("%s: recording format %d is newer than this version reads", file, r.header.Recording)
+	}
+	var all []recordEntry
+	for line := 2; sc.Scan(); line++ {
+		var e recordEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		all = append(all, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	peer, own := "", ""
+	for _, e := range all {
+		if e.Dir == recordReceived {
+			peer = e.Info.Source
+			if e.Room != recordRendezvous {
+				own = e.Room
+			}
+			break
+		}
+	}
+	if peer == "" {
+		return nil, fmt.Errorf("%s: nothing received to replay", file)
+	}
+	var last int64
+	for _, e := range all {
+		switch {
+		case e.Dir == recordSent && (e.Room == peer || e.Info.Source == own):
+			r.sent = append(r.sent, e)
+			last = e.At
+		case e.Dir == recordReceived && e.Info.Source == peer:
+			gap := time.Duration(e.At-last) * time.Millisecond
+			r.received = append(r.received, replayEntry{recordEntry: e, after: len(r.sent), gap: gap})
+		}
+	}
+	return r, nil
+}
+
+// client reports whether the recording was made by the client side.
+func (r *signalReplay) client() bool {
+	return r.header.Role != "server"
+}
+
+// post takes the place of sending info to the signaling server.
+func (r *signalReplay) post(info signaling.ConnectInfo) error {
+	r.mu.Lock()
+	n := len(r.sentAt)
+	r.sentAt = append(r.sentAt, time.Now())
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+	log.Printf("replay: +%s sent %s", r.elapsed(), describeInfo(info))
+	if n < len(r.sent) {
+		log.Printf("replay: recorded at +%dms: %s", r.sent[n].At, describeInfo(r.sent[n].Info))
+	} else {
+		log.Println("replay: the recording sent no such message")
+	}
+	return nil
+}
+
+// pull takes the place of pulling room from the signaling server. The
+// channel closes once the recording has no more messages for room.
+func (r *signalReplay) pull(ctx context.Context, room string) <-chan signaling.ConnectInfo {
+	ch := make(chan signaling.ConnectInfo)
+	rendezvous := room == r.rendezvous
+	go func() {
+		defer close(ch)
+		for {
+			e := r.next(rendezvous)
+			if e == nil {
+				return
+			}
+			due, ok := r.due(ctx, e)
+			if !ok {
+				return
+			}
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+				return
+			}
+			log.Printf("replay: +%s received %s (recorded at +%dms)", r.elapsed(), describeInfo(e.Info), e.At)
+			select {
+			case ch <- e.Info:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// next takes the next received message of the rendezvous room or, when
+// rendezvous is false, of a session room.
+func (r *signalReplay) next(rendezvous bool) *replayEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.received {
+		e := &r.received[i]
+		if !e.taken && (e.Room == recordRendezvous) == rendezvous {
+			e.taken = true
+			return e
+		}
+	}
+	return nil
+}
+
+// due waits for the message e follows to be sent, returning when e is due.
+func (r *signalReplay) due(ctx context.Context, e *replayEntry) (time.Time, bool) {
+	for {
+		r.mu.Lock()
+		n, changed, base := len(r.sentAt), r.changed, r.start
+		if e.after > 0 && n >= e.after {
+			base = r.sentAt[e.after-1]
+		}
+		r.mu.Unlock()
+		if n >= e.after {
+			if r.speed <= 0 {
+				return base, true
+			}
+			return base.Add(time.Duration(float64(e.gap) / r.speed)), true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return time.Time{}, false
+		}
+	}
+}
+
+func (r *signalReplay) elapsed() time.Duration {
+	return time.Since(r.start).Round(time.Millisecond)
+}
+
+// describeInfo summarizes a signaling message for the replay log.
+func describeInfo(info signaling.ConnectInfo) string {
+	var b strings.Builder
+	switch {
+	case info.SDP == "":
+		fmt.Fprintf(&b, "request for %q", info.Label)
+	default:
+		counts := map[string]int{}
+		var kinds []string
+		for _, line := range strings.Split(info.SDP, "\r\n") {
+			key, typ, ok := parseCandidate(line)
+			if !ok {
+				continue
+			}
+			k := typ + "/" + candidateFamily(key)
+			if counts[k] == 0 {
+				kinds = append(kinds, k)
+			}
+			counts[k]++
+		}
+		cands := make([]string, len(kinds))
+		for i, k := range kinds {
+			cands[i] = strconv.Itoa(counts[k]) + " " + k
+		}
+		if len(cands) == 0 {
+			cands = []string{"none"}
+		}
+		fmt.Fprintf(&b, "sdp of %d bytes, candidates: %s", len(info.SDP), strings.Join(cands, ", "))
+	}
+	fmt.Fprintf(&b, ", schema v%d", info.Version)
+	if info.AEAD != "" {
+		fmt.Fprintf(&b, ", aead %s", info.AEAD)
+	}
+	if len(info.PublicKey) > 0 {
+		b.WriteString(", signed")
+	}
+	if info.Banner != "" {
+		b.WriteString(", banner")
+	}
+	return b.String()
+}
+
+// replaySignaling runs the side that made the recording in file against
+// the peer messages in it. Without the recorded peer ICE cannot complete,
+// so waiting for the data channel to open timing out is what a replay
+// that got that far ends with.
+func replaySignaling(file, key, addr string, speed float64, timeout time.Duration) error {
+	r, err := loadReplay(file, speed)
+	if err != nil {
+		return err
+	}
+	r.rendezvous = room(key)
+	r.start = time.Now()
+	replay = r
+	redacted := ""
+	if r.header.Redacted {
+		redacted = ", redacted"
+	}
+	log.Printf("replay: %s side of %s, recorded %s%s: %d messages sent, %d received",
+		r.header.Role, file, r.header.Start.Format(time.RFC3339), redacted, len(r.sent), len(r.received))
+	if len(r.sent) > 0 {
+		first := r.sent[0].Info
+		if r.client() {
+			askOffer = first.SDP == ""
+			aeadRequired = first.AEAD != ""
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if r.client() {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		s, err := connect(ctx, room(key), "", "", appHint, local)
+		if err == nil {
+			err = s.wait(timeout)
+		}
+		return replayResult(err, timeout)
+	}
+	once, handshakeTimeout, acceptOffers = true, timeout, true
+	err = serve(ctx, room(key), addr)
+	if err == nil {
+		err = errors.New("replay: the recorded messages set up no session")
+	}
+	return replayResult(err, timeout)
+}
+
+func replayResult(err error, timeout time.Duration) error {
+	if errors.Is(err, errTimeout) {
+		log.Printf("replay: done, no data channel within %s, as expected without the recorded peer", timeout)
+		return nil
+	}
+	return err
+}
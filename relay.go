@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relayPairs counts the paired connections, published as relay_pairs by
+// a relay with -metrics.
+var relayPairs expvar.Int
+
+// maxRelayLine is the longest key line the relay reads, and the most an
+// endpoint may send ahead of being paired before it is no longer watched
+// for closing.
+const maxRelayLine = 512
+
+// relay pairs up TCP connections presenting the same room key and splices
+// their byte streams together. The first line sent by each endpoint is
+// "KEY" or "KEY TOKEN" when the relay requires a token.
+type relay struct {
+	token    string
+	timeout  time.Duration
+	maxConns int
+
+	mu      sync.Mutex
+	waiting map[string]*relayWaiter
+	active  map[string]bool
+}
+
+// relayWaiter is an endpoint waiting for its peer. Until it is paired its
+// reader is watched for the endpoint closing, so that the peer is not
+// paired with a dead connection.
+type relayWaiter struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	watched chan struct{} // closed once the watch stopped reading br
+}
+
+func (r *relay) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *relay) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(r.timeout))
+	br := bufio.NewReaderSize(conn, maxRelayLine)
+	b, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = fmt.Errorf("key line longer than %d bytes", maxRelayLine)
+	}
+	if err != nil {
+		log.Println("relay handshake failed:", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || (r.token != "" && (len(fields) < 2 || subtle.ConstantTimeCompare([]byte(fields[1]), []byte(r.token)) != 1)) {
+		log.Println("relay rejected:", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	key := fields[0]
+
+	r.mu.Lock()
+	if r.active[key] {
+		r.mu.Unlock()
+		log.Println("relay rejected, key in use:", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if r.maxConns > 0 && len(r.waiting)+2*len(r.active) >= r.maxConns {
+		r.mu.Unlock()
+		log.Println("relay rejected, connection limit reached:", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	peer, ok := r.waiting[key]
+	var w *relayWaiter
+	if ok {
+		delete(r.waiting, key)
+		r.active[key] = true
+	} else {
+		w = &relayWaiter{conn: conn, br: br, watched: make(chan struct{})}
+		r.waiting[key] = w
+		conn.SetReadDeadline(time.Time{})
+		go r.watch(key, w)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		time.AfterFunc(r.timeout, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.waiting[key] == w {
+				delete(r.waiting, key)
+				log.Println("relay unpaired timeout:", conn.RemoteAddr())
+				conn.Close()
+			}
+		})
+		return
+	}
+	// wake the watch of the peer and wait for it to let go of its reader
+	peer.conn.SetReadDeadline(time.Now())
+	<-peer.watched
+	conn.SetReadDeadline(time.Time{})
+	peer.conn.SetReadDeadline(time.Time{})
+	log.Println("relay paired:", peer.conn.RemoteAddr(), "<->", conn.RemoteAddr())
+	relayPairs.Add(1)
+	defer func() {
+		relayPairs.Add(-1)
+		r.mu.Lock()
+		delete(r.active, key)
+		r.mu.Unlock()
+	}()
+	c, pc := relayConn(conn, br), relayConn(peer.conn, peer.br)
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(pc, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, pc)
+		done <- struct{}{}
+	}()
+	<-done
+	pc.Close()
+	c.Close()
+	<-done
+	log.Println("relay closed:", peer.conn.RemoteAddr(), "<->", conn.RemoteAddr())
+}
+
+// watch removes w from the waiting endpoints of key when it closes. The
+// watch peeks only, so whatever the endpoint sends ahead of its peer is
+// kept for it; once that fills the reader, the endpoint is left to the
+// unpaired timeout.
+func (r *relay) watch(key string, w *relayWaiter) {
+	defer close(w.watched)
+	var err error
+	for err == nil {
+		_, err = w.br.Peek(w.br.Buffered() + 1)
+	}
+	if err == bufio.ErrBufferFull {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.waiting[key] == w {
+		delete(r.waiting, key)
+		log.Println("relay waiting endpoint closed:", w.conn.RemoteAddr(), err)
+		w.conn.Close()
+	}
+}
+
+// relayConn is conn read through br. Anything the endpoint sent after the
+// key line must not be lost, but keep the bare *net.TCPConn when possible
+// so io.Copy can splice.
+func relayConn(conn net.Conn, br *bufio.Reader) net.Conn {
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}
+	}
+	return conn
+}
+
+// bufferedConn reads through the buffered reader used for the handshake.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
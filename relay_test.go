@@ -0,0 +1,109 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startRelay runs a relay requiring token, returning it and its address.
+func startRelay(t *testing.T, token string) (*relay, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	r := &relay{token: token, timeout: 2 * time.Second, waiting: map[string]*relayWaiter{}, active: map[string]bool{}}
+	go r.serve(l)
+	return r, l.Addr().String()
+}
+
+// relayDial connects to the relay at addr, sending the key line.
+func relayDial(t *testing.T, addr, line string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, line+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestRelayToken(t *testing.T) {
+	_, addr := startRelay(t, "secret")
+	a := relayDial(t, addr, "room secret")
+	b := relayDial(t, addr, "room secret")
+	if _, err := io.WriteString(a, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("paired endpoints: read %q, %v", buf, err)
+	}
+	for _, line := range []string{"other secreT", "other secre", "other"} {
+		c := relayDial(t, addr, line)
+		if _, err := c.Read(buf); err != io.EOF {
+			t.Errorf("%q: got %v, want rejected", line, err)
+		}
+	}
+}
+
+func TestRelayLongLine(t *testing.T) {
+	_, addr := startRelay(t, "")
+	c := relayDial(t, addr, strings.Repeat("k", maxRelayLine))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("key line past %d bytes not rejected", maxRelayLine)
+	}
+}
+
+// TestRelayClosedWaiter closes an endpoint while it waits: the next one
+// presenting its key must wait in its place for a live peer, and get what
+// that peer sent ahead of being paired.
+func TestRelayClosedWaiter(t *testing.T) {
+	r, addr := startRelay(t, "")
+	waiting := func(want int) {
+		t.Helper()
+		for end := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			r.mu.Lock()
+			n := len(r.waiting)
+			r.mu.Unlock()
+			if n == want {
+				return
+			}
+			if time.Now().After(end) {
+				t.Fatalf("%d endpoints waiting, want %d", n, want)
+			}
+		}
+	}
+	c := relayDial(t, addr, "room")
+	waiting(1)
+	c.Close()
+	waiting(0)
+	a := relayDial(t, addr, "room\nearly")
+	b := relayDial(t, addr, "room")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "early" {
+		t.Fatalf("paired endpoints: read %q, %v", buf, err)
+	}
+	if _, err := io.WriteString(b, "late"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(a, buf[:4]); err != nil || string(buf[:4]) != "late" {
+		t.Fatalf("paired endpoints: read %q, %v", buf[:4], err)
+	}
+}
+
+// TestRelayPairsUnpublished checks relay_pairs is left to the relay mode.
+func TestRelayPairsUnpublished(t *testing.T) {
+	if v := expvar.Get("relay_pairs"); v != nil {
+		t.Fatalf("relay_pairs published outside relay mode: %v", v)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// retries is the budget shared by signaling retries and rebuilding
+// pre-warmed tunnels. Once more than max retries fall within window the
+// peer is taken to be down and every further retry waits backoff on top
+// of its own interval, until a connection comes up or the window rolls
+// over.
+var retries = &retryBudget{window: time.Minute, backoff: time.Minute}
+
+type retryBudget struct {
+	max     int // 0 = unlimited
+	window  time.Duration
+	backoff time.Duration
+
+	mu        sync.Mutex
+	start     time.Time
+	spent     int
+	exhausted bool
+}
+
+// spend records a retry and returns the extra delay before taking it.
+func (b *retryBudget) spend() time.Duration {
+	if b.max <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.start) > b.window {
+		b.start, b.spent, b.exhausted = now, 0, false
+	}
+	b.spent++
+	if b.spent <= b.max {
+		return 0
+	}
+	if !b.exhausted {
+		b.exhausted = true
+		log.Printf("retry budget spent (%d in %s): peer appears persistently unreachable, backing off %s per retry", b.max, b.window, b.backoff)
+	}
+	return b.backoff
+}
+
+// reset refills the budget after a connection came up.
+func (b *retryBudget) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted {
+		log.Println("retry budget reset: peer reachable again")
+	}
+	b.start, b.spent, b.exhausted = time.Time{}, 0, false
+}
+
+// sleep waits d plus what spending a retry costs.
+func (b *retryBudget) sleep(d time.Duration) {
+	time.Sleep(d + b.spend())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var routeName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// routeFlag maps route names to server side destinations, set as
+// "name:host:port" (repeatable).
+type routeFlag map[string]string
+
+func (r routeFlag) String() string {
+	var list []string
+	for name, dst := range r {
+		list = append(list, name+":"+dst)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func (r routeFlag) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i < 0 {
+		return fmt.Errorf("invalid route %q: want name:host:port", v)
+	}
+	name, dst := v[:i], v[i+1:]
+	if err := validRoute(name); err != nil {
+		return err
+	}
+	if name == sniLabel {
+		return fmt.Errorf("route name %q is taken by -sni", name)
+	}
+	if _, _, err := net.SplitHostPort(dst); err != nil {
+		return fmt.Errorf("invalid route %q: %v", v, err)
+	}
+	if _, ok := r[name]; ok {
+		return fmt.Errorf("duplicate route %q", name)
+	}
+	r[name] = dst
+	return nil
+}
+
+// validRoute checks a route name. Names start with a letter so they never
+// read as a port, and "data" is the default channel label.
+func validRoute(name string) error {
+	if !routeName.MatchString(name) || name == "data" {
+		return fmt.Errorf("invalid route name %q", name)
+	}
+	return nil
+}
+
+// rewriteFlag maps destinations clients ask for to the ones the server
+// dials, set as "host:port=host:port" (repeatable).
+type rewriteFlag map[string]string
+
+func (r rewriteFlag) String() string {
+	var list []string
+	for from, to := range r {
+		list = append(list, from+"="+to)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func (r rewriteFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("invalid rewrite %q: want host:port=host:port", v)
+	}
+	from, to := v[:i], v[i+1:]
+	for _, a := range []string{from, to} {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("invalid rewrite %q: %v", v, err)
+		}
+	}
+	r[from] = to
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func withTargets(t *testing.T, allow []string, rewrite ...string) {
+	t.Helper()
+	oldAllow, oldRewrites := allowTargets, rewrites
+	allowTargets, rewrites = allow, rewriteFlag{}
+	for _, v := range rewrite {
+		if err := rewrites.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { allowTargets, rewrites = oldAllow, oldRewrites })
+}
+
+func TestTargetRewrite(t *testing.T) {
+	const dial = "127.0.0.1:22"
+	withTargets(t, []string{"127.0.0.1:5432", "web:80"},
+		"db:5432=127.0.0.1:5432",
+		"web:80=10.0.0.9:80",
+		"shell:22="+dial,
+	)
+	for _, c := range []struct {
+		name, label, want string
+	}{
+		{"rewritten target allowed", "db:5432", "127.0.0.1:5432"},
+		{"rewritten target denied", "web:80", ""},
+		{"rewritten to -dial", "shell:22", dial},
+		{"no rewrite, allowed", "127.0.0.1:5432", "127.0.0.1:5432"},
+		{"no rewrite, -dial host", ":5432", "127.0.0.1:5432"},
+		{"no rewrite, denied", "db:5433", ""},
+	} {
+		got, err := target(dial, c.label)
+		if c.want == "" {
+			if !errors.Is(err, errAuthRejected) {
+				t.Errorf("%s: %s reached %q, %v; want auth rejected", c.name, c.label, got, err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: %s reached %q, %v; want %s", c.name, c.label, got, err, c.want)
+		}
+	}
+}
+
+// TestTargetLoopback checks -allow and -dial match however the loopback
+// host and the port are spelled.
+func TestTargetLoopback(t *testing.T) {
+	withTargets(t, []string{"127.0.0.1:5432", "[::1]:6379", "Db.Example.:3306"})
+	for _, c := range []struct {
+		dial, label string
+		ok          bool
+	}{
+		{"localhost:22", "127.0.0.1:22", true},
+		{"localhost:22", "[::1]:22", true},
+		{"localhost:22", ":22", true},
+		{"127.0.0.1:22", "localhost:22", true},
+		{"127.0.0.1:22", "[::ffff:127.0.0.1]:22", true},
+		{"localhost:22", "localhost:022", true},
+		{"localhost:22", "localhost:5432", true},
+		{"localhost:22", "[0:0::1]:6379", true},
+		{"localhost:22", "db.example.com:3306", false},
+		{"localhost:22", "db.example:3306", true},
+		{"localhost:22", "127.0.0.2:22", false},
+		{"localhost:22", "localhost:23", false},
+		{"localhost:22", "[::1]:5433", false},
+	} {
+		_, err := target(c.dial, c.label)
+		if c.ok && err != nil {
+			t.Errorf("-dial %s: %s refused: %v", c.dial, c.label, err)
+		}
+		if !c.ok && !errors.Is(err, errAuthRejected) {
+			t.Errorf("-dial %s: %s allowed, want auth rejected", c.dial, c.label)
+		}
+	}
+}
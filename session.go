@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nobonobo/ssh-p2p/signaling"
+	"github.com/pions/webrtc"
+)
+
+// session is one tunneled TCP connection and the PeerConnection carrying it.
+type session struct {
+	id      string
+	pc      *webrtc.RTCPeerConnection
+	started time.Time
+
+	mu       sync.Mutex
+	peer     string
+	instance string
+	name     string
+	addr     string
+	origin   string
+	msgSize  int
+	proxy    bool
+	conn     net.Conn
+	target   string
+	forward  string
+	local    []string
+	remote   []string
+	open     bool
+	closed   bool
+	err      error
+	done     chan struct{}
+
+	// handshake is set while s holds a -max-concurrent-handshakes slot.
+	handshake bool
+
+	// wantFamily restricts the advertised candidates to one family;
+	// family is the one family of those advertised, if they are.
+	wantFamily string
+	family     string
+	advertised bool
+	iceUp      chan struct{}
+	iceOnce    sync.Once
+
+	// header guards the -proxy-protocol header, sent once before data.
+	header    sync.Once
+	headerErr error
+
+	stall   stallWatch
+	write   writeWatch
+	hostKey *hostKeyCheck
+	aead    *aeadTunnel
+	app     *appWatch
+	trace   *sessionTrace
+}
+
+// sessions holds the live sessions by id.
+var sessions = struct {
+	sync.Mutex
+	m map[string]*session
+}{m: map[string]*session{}}
+
+// maxConns caps the live sessions, each one tunneled connection; zero is
+// unlimited.
+var maxConns int
+
+var errConnLimit = errors.New("connection limit reached (-max-conns)")
+
+func newSession(id string, pc *webrtc.RTCPeerConnection) (*session, error) {
+	s := &session{id: id, pc: pc, started: time.Now(), done: make(chan struct{}), iceUp: make(chan struct{})}
+	sessions.Lock()
+	defer sessions.Unlock()
+	if maxConns > 0 && len(sessions.m) >= maxConns {
+		return nil, errConnLimit
+	}
+	sessions.m[id] = s
+	return s, nil
+}
+
+// sessionCount returns the number of live sessions.
+func sessionCount() int {
+	sessions.Lock()
+	defer sessions.Unlock()
+	return len(sessions.m)
+}
+
+// maxForwardName bounds forward names, which label logs and metrics.
+const maxForwardName = 32
+
+// validForwardName checks a forward name; like route names they start
+// with a letter.
+func validForwardName(name string) bool {
+	return len(name) <= maxForwardName && routeName.MatchString(name)
+}
+
+// forwardSessions returns the live sessions per forward name, for the
+// forward_sessions metric. Sessions without a name are not counted.
+func forwardSessions() interface{} {
+	m := map[string]int{}
+	for _, s := range listSessions() {
+		if f := s.forwardName(); f != "" {
+			m[f]++
+		}
+	}
+	return m
+}
+
+// setForward tags s with the name of the forward it serves.
+func (s *session) setForward(name string) {
+	s.mu.Lock()
+	s.forward = name
+	s.mu.Unlock()
+}
+
+func (s *session) forwardName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forward
+}
+
+// logf logs for s, prefixed with "forward=NAME" when it serves a named
+// forward so that the lines of one forward can be filtered.
+func (s *session) logf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if f := s.forwardName(); f != "" {
+		msg = "forward=" + f + " " + msg
+	}
+	log.Output(2, msg)
+}
+
+// attach sets the tunneled connection, closing it right away when the
+// session is already gone.
+func (s *session) attach(conn net.Conn, target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conn = conn
+	s.target = target
+	return true
+}
+
+// setPeer records the signing peer's fingerprint and run instance.
+func (s *session) setPeer(peer, instance string) {
+	s.mu.Lock()
+	s.peer = peer
+	s.instance = instance
+	s.mu.Unlock()
+}
+
+// reclaim closes the sessions peer opened in an earlier run, that is
+// under another instance.
+func reclaim(peer, instance string) {
+	for _, s := range listSessions() {
+		s.mu.Lock()
+		stale := s.peer == peer && s.instance != instance
+		s.mu.Unlock()
+		if stale {
+			log.Println("reclaiming session of restarted peer:", s.id, peer)
+			s.Close()
+		}
+	}
+}
+
+// claim records the verified sender of v on s, first closing that sender's
+// sessions from an earlier run.
+func (s *session) claim(v signaling.ConnectInfo) {
+	if peer, err := peerID(v); err == nil && v.Instance != "" {
+		reclaim(peer, v.Instance)
+		s.setPeer(peer, v.Instance)
+	}
+	s.setName(v)
+	s.setOrigin(v.Origin)
+	s.trace.join(v.Trace)
+}
+
+// maxClientName bounds the -client-name a peer may send.
+const maxClientName = 64
+
+var clientNameChars = regexp.MustCompile(`^[A-Za-z0-9._@:-]+$`)
+
+func validClientName(name string) bool {
+	return len(name) <= maxClientName && clientNameChars.MatchString(name)
+}
+
+// setName records the name the sender of v goes by: its -client-name, or
+// its candidate address. An invalid name is ignored.
+func (s *session) setName(v signaling.ConnectInfo) {
+	addr := candidateAddr(v.SDP)
+	if addr != "" {
+		s.mu.Lock()
+		s.addr = addr
+		s.mu.Unlock()
+	}
+	name := v.Name
+	if name != "" && !validClientName(name) {
+		s.logf("session %s: ignoring invalid client name %q", s.id, name)
+		name = ""
+	}
+	if name == "" {
+		name = addr
+	}
+	if name == "" {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+	s.logf("session %s name: %s", s.id, name)
+}
+
+// reflexive records the public addresses in the local and remote SDP
+// when -show-public-ip is set.
+func (s *session) reflexive(local, remote string) {
+	if !showPublicIP {
+		return
+	}
+	l, r := srflxAddrs(local), srflxAddrs(remote)
+	s.logf("session %s public addresses: local %v, remote %v", s.id, l, r)
+	s.mu.Lock()
+	s.local, s.remote = l, r
+	s.mu.Unlock()
+}
+
+// iceConnected records that ICE connected, logging over which family
+// when that is known.
+func (s *session) iceConnected() {
+	s.iceOnce.Do(func() { close(s.iceUp) })
+	if f := s.selectedFamily(); f != "" {
+		s.logf("session %s ice connected over %s", s.id, f)
+	}
+}
+
+// opened records that the data channel is up.
+func (s *session) opened() {
+	s.mu.Lock()
+	s.open = true
+	s.mu.Unlock()
+	s.releaseHandshake()
+	s.trace.end(traceHandshake)
+	s.finishTrace(nil)
+}
+
+// inUse reports whether s carries a stream: its data channel is open and
+// its local connection is not a pre-warmed stand-in still waiting for use.
+func (s *session) inUse() bool {
+	s.mu.Lock()
+	open, conn := s.open, s.conn
+	s.mu.Unlock()
+	if w, ok := conn.(*warmConn); ok && w.attached() == nil {
+		return false
+	}
+	return open
+}
+
+// wait blocks until the session ends. When the data channel did not open
+// (within timeout, after which the session is closed) it fails with the
+// reason the session went down.
+func (s *session) wait(timeout time.Duration) error {
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+	s.mu.Lock()
+	open := s.open
+	s.mu.Unlock()
+	if !open {
+		s.fail(fmt.Errorf("%w: data channel not open after %s", errTimeout, timeout))
+		s.mu.Lock()
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			err = errors.New("session closed before the data channel opened")
+		}
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+// fail closes the session, recording err as the reason unless an earlier
+// one was recorded.
+func (s *session) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil && !s.closed {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.Close()
+}
+
+func (s *session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	conn, open, err := s.conn, s.open, s.err
+	s.mu.Unlock()
+	s.releaseHandshake()
+	s.diagnoseApp(open, err)
+	if err == nil {
+		err = errors.New("session closed before the data channel opened")
+	}
+	s.finishTrace(err)
+	sessions.Lock()
+	delete(sessions.m, s.id)
+	sessions.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return s.pc.Close()
+}
+
+// sessionInfo is the status view of a session.
+type sessionInfo struct {
+	ID      string    `json:"id"`
+	Peer    string    `json:"peer,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Target  string    `json:"target"`
+	Forward string    `json:"forward,omitempty"`
+	Origin  string    `json:"origin,omitempty"`
+	Started time.Time `json:"started"`
+	AEAD    bool      `json:"aead,omitempty"`
+	// LocalPublic and RemotePublic are set with -show-public-ip.
+	LocalPublic  []string `json:"local_public,omitempty"`
+	RemotePublic []string `json:"remote_public,omitempty"`
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sessionInfo{
+		ID:           s.id,
+		Peer:         s.peer,
+		Name:         s.name,
+		Target:       s.target,
+		Forward:      s.forward,
+		Origin:       s.origin,
+		Started:      s.started,
+		AEAD:         s.aead != nil && s.aead.send != nil,
+		LocalPublic:  s.local,
+		RemotePublic: s.remote,
+	}
+}
+
+// listSessions returns the live sessions, oldest first.
+func listSessions() []*session {
+	sessions.Lock()
+	defer sessions.Unlock()
+	var list []*session
+	for _, s := range sessions.m {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].started.Before(list[j].started) })
+	return list
+}
+
+// closeSessions closes every live session.
+func closeSessions() {
+	for _, s := range listSessions() {
+		s.Close()
+	}
+}
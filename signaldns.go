@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	// signalingIP is -signaling-ip, dialed for the signaling host instead
+	// of resolving it.
+	signalingIP string
+	// signalingCache is -signaling-cache: how long resolved signaling
+	// addresses are reused; zero resolves on every new connection.
+	signalingCache time.Duration
+)
+
+// signalingTransport returns the transport of signaling requests, set up
+// on first use.
+func signalingTransport() *http.Transport {
+	if t, ok := client.Transport.(*http.Transport); ok {
+		return t
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	client.Transport = t
+	return t
+}
+
+// signalingDialer dials the signaling host at cached or fixed addresses.
+// Requests keep the host name in their URL, so TLS still verifies the
+// certificate against it.
+type signalingDialer struct {
+	host string
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu       sync.Mutex
+	addrs    []string
+	resolved time.Time
+}
+
+// addresses returns the signaling host's addresses, resolving again when
+// the cache expired. A failed lookup keeps the previous addresses.
+func (d *signalingDialer) addresses(ctx context.Context) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if signalingIP != "" {
+		return []string{signalingIP}, nil
+	}
+	if d.addrs != nil && time.Since(d.resolved) < signalingCache {
+		return d.addrs, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, d.host)
+	if err != nil {
+		if d.addrs == nil {
+			return nil, err
+		}
+		log.Printf("resolving signaling host %s failed, keeping %v: %v", d.host, d.addrs, err)
+		d.resolved = time.Now()
+		return d.addrs, nil
+	}
+	d.addrs, d.resolved = addrs, time.Now()
+	return addrs, nil
+}
+
+func (d *signalingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != d.host {
+		return d.dial(ctx, network, addr)
+	}
+	addrs, err := d.addresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		conn, err = d.dial(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// setupSignalingDNS applies -signaling-ip and -signaling-cache, resolving
+// the signaling host once up front.
+func setupSignalingDNS() {
+	if signalingIP == "" && signalingCache <= 0 {
+		return
+	}
+	if signalingIP != "" && net.ParseIP(signalingIP) == nil {
+		fatalConfig(fmt.Sprintf("invalid -signaling-ip %q: not an IP address", signalingIP))
+	}
+	u, err := url.Parse(signalingURL)
+	if err != nil || u.Hostname() == "" {
+		fatalConfig(fmt.Sprintf("invalid -signaling %q", signalingURL))
+	}
+	t := signalingTransport()
+	d := &signalingDialer{host: u.Hostname(), dial: t.DialContext}
+	if d.dial == nil {
+		d.dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = d.DialContext
+	if signalingIP != "" {
+		log.Printf("signaling host %s: using %s", d.host, signalingIP)
+		return
+	}
+	addrs, err := d.addresses(context.Background())
+	if err != nil {
+		log.Printf("resolving signaling host %s: %v", d.host, err)
+		return
+	}
+	log.Printf("signaling host %s: %v, resolved again every %s", d.host, addrs, signalingCache)
+}
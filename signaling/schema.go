@@ -3,8 +3,65 @@ package signaling
 // URI default signaling server
 const URI = "https://nobo-signaling.appspot.com"
 
+// Version of the ConnectInfo schema. Messages without a version are
+// version 0, which differs only by lacking the optional fields. Since
+// version 2 the signature covers more than the SDP, and since version 3
+// every other field too, see PublicKey.
+const Version = 3
+
 // ConnectInfo SDP by offer or answer
 type ConnectInfo struct {
-	Source string `json:"source"`
-	SDP    string `json:"sdp"`
+	Version int    `json:"version,omitempty"`
+	Source  string `json:"source"`
+	SDP     string `json:"sdp"`
+	// PublicKey and Signature identify the sender when it runs with an
+	// identity key. The signature is ed25519 over every other field,
+	// length prefixed.
+	PublicKey []byte `json:"pubkey,omitempty"`
+	Signature []byte `json:"sig,omitempty"`
+	// Instance is random per run of a signing peer; a new one tells the
+	// other side that sessions under the old one are gone.
+	Instance string `json:"instance,omitempty"`
+	// Nonce, random per message, and Time, in unix seconds, make a signed
+	// message fresh: receivers refuse one seen before or too old.
+	Nonce string `json:"nonce,omitempty"`
+	Time  int64  `json:"time,omitempty"`
+	// Label, sent without SDP, asks the receiver to make the offer for a
+	// data channel with this label.
+	Label string `json:"label,omitempty"`
+	// Name is an optional client chosen name for operator attribution
+	// only; it is not authenticated.
+	Name string `json:"name,omitempty"`
+	// AEAD names the cipher for app-layer encryption of the tunneled
+	// stream, asked for by a client and agreed to by a server; Salt is the
+	// sender's random contribution to its keys.
+	AEAD string `json:"aead,omitempty"`
+	Salt []byte `json:"salt,omitempty"`
+	// Origin is the address the client's local connection came from, as
+	// named by a PROXY protocol header in front of the client.
+	Origin string `json:"origin,omitempty"`
+	// Banner is a notice from the server for the client to show its
+	// user, such as a usage policy.
+	Banner string `json:"banner,omitempty"`
+	// Trace is the W3C traceparent of the sender's connection setup, for
+	// the receiver's spans to join its trace.
+	Trace string `json:"trace,omitempty"`
+	// Keepalive asks the receiver to send a keepalive, an empty text
+	// message, over the data channel whenever it sent nothing for this
+	// many milliseconds; set by peers that understand keepalives.
+	Keepalive int64 `json:"keepalive,omitempty"`
+}
+
+// DefaultMaxSDPSize bounds the SDP peers and the signaling server accept.
+const DefaultMaxSDPSize = 64 << 10
+
+// MaxBodySize is the largest JSON encoded ConnectInfo expected for an SDP
+// of at most maxSDP bytes, leaving room for escaping and the other fields.
+func MaxBodySize(maxSDP int64) int64 {
+	return 2*maxSDP + 4096
+}
+
+// Compatible reports whether a message of schema version v is understood.
+func Compatible(v int) bool {
+	return v <= Version
 }
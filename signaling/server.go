@@ -0,0 +1,114 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server relays ConnectInfo messages: a push to /push/ID is handed to a
+// peer long polling /pull/ID on the same instance.
+type Server struct {
+	// MaxSDPSize caps pushed SDPs, DefaultMaxSDPSize when zero.
+	MaxSDPSize int64
+
+	mu  sync.RWMutex
+	res map[string]chan ConnectInfo
+}
+
+// Handler returns the HTTP handler serving /push/ and /pull/. It allows
+// cross-origin requests so that browser peers can signal too.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/pull/", http.StripPrefix("/pull/", s.pullData()))
+	mux.Handle("/push/", http.StripPrefix("/push/", s.pushData()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			h.Set("Access-Control-Allow-Methods", "GET, POST")
+			h.Set("Access-Control-Allow-Headers", "Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) maxSDPSize() int64 {
+	if s.MaxSDPSize > 0 {
+		return s.MaxSDPSize
+	}
+	return DefaultMaxSDPSize
+}
+
+func (s *Server) pushData() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info ConnectInfo
+		max := s.maxSDPSize()
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize(max))
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			log.Print("json decode failed:", err)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if int64(len(info.SDP)) > max {
+			log.Print("sdp too large:", len(info.SDP))
+			http.Error(w, fmt.Sprintf("sdp too large: %d bytes (max %d)", len(info.SDP), max), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !Compatible(info.Version) {
+			log.Print("unsupported schema version:", info.Version)
+			http.Error(w, fmt.Sprintf("unsupported schema version %d (server %d)", info.Version, Version), http.StatusConflict)
+			return
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		select {
+		default:
+			// nobody is pulling on this instance (yet); the pusher retries,
+			// possibly reaching the instance that holds the puller.
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case s.res[r.URL.Path] <- info:
+		}
+	})
+}
+
+func (s *Server) pullData() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		if s.res == nil {
+			s.res = map[string]chan ConnectInfo{}
+		}
+		ch := s.res[r.URL.Path]
+		if ch == nil {
+			ch = make(chan ConnectInfo)
+			s.res[r.URL.Path] = ch
+		}
+		s.mu.Unlock()
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			http.Error(w, ``, http.StatusRequestTimeout)
+			return
+		case v := <-ch:
+			w.Header().Add("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(v); err != nil {
+				log.Print("json encode failed:", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushOversizedSDP(t *testing.T) {
+	h := (&Server{MaxSDPSize: 8}).Handler()
+	for name, body := range map[string]string{
+		"sdp":  `{"source":"a","sdp":"v=0123456789"}`,
+		"body": `{"source":"a","sdp":"v=0","label":"` + strings.Repeat("x", int(MaxBodySize(8))) + `"}`,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/push/big", strings.NewReader(body)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("oversized %s: status %d, want %d", name, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/push/big", strings.NewReader(`{"source":"a","sdp":"v=0"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("small sdp: status %d, want %d (nobody pulling)", w.Code, http.StatusNotFound)
+	}
+}
+
+func FuzzPush(f *testing.F) {
+	for _, info := range []ConnectInfo{
+		{Version: Version, Source: "a", SDP: "v=0"},
+		{Version: Version + 1, Source: "a", SDP: "v=0"},
+		{Version: Version, Source: "a", SDP: "v=0123456789"},
+	} {
+		b, err := json.Marshal(info)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte(`{"sdp":`))
+	s := &Server{MaxSDPSize: 8}
+	h := s.Handler()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/push/fuzz", bytes.NewReader(b)))
+		var info ConnectInfo
+		valid := json.Unmarshal(b, &info) == nil && len(info.SDP) <= 8 && Compatible(info.Version)
+		switch w.Code {
+		case http.StatusNotFound:
+			// accepted, with nobody pulling
+			if !valid {
+				t.Fatalf("%q accepted", b)
+			}
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusConflict:
+		default:
+			t.Fatalf("%q: status %d", b, w.Code)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/nobonobo/ssh-p2p/signaling"
+)
+
+// serveSignaling runs the built-in signaling server on addr.
+func serveSignaling(addr string) {
+	s := &signaling.Server{MaxSDPSize: maxSDPSize}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("signaling listen:", addr)
+	if signalTLSCert != "" {
+		r, err := newCertReloader(signalTLSCert, signalTLSKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		l = tls.NewListener(l, &tls.Config{GetCertificate: r.GetCertificate})
+	}
+	go func() {
+		log.Println(http.Serve(l, s.Handler()))
+	}()
+}
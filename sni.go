@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sniLabel is the data channel label, and client -forward route, that
+// picks the destination by the TLS server name the client asks for.
+const sniLabel = "sni"
+
+// sniRoutes map TLS server names to server side destinations, set as
+// "name=host:port" (repeatable). A name "*.example.com" matches any one
+// level subdomain. Names without a route go to sniDefault, or are refused
+// when it is empty.
+var (
+	sniRoutes  = sniFlag{}
+	sniDefault string
+	sniTimeout = 10 * time.Second
+)
+
+type sniFlag map[string]string
+
+func (r sniFlag) String() string {
+	var list []string
+	for name, dst := range r {
+		list = append(list, name+"="+dst)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func (r sniFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("invalid sni route %q: want name=host:port", v)
+	}
+	name, dst := strings.ToLower(strings.TrimSuffix(v[:i], ".")), v[i+1:]
+	if name == "" || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return fmt.Errorf("invalid sni route %q: want a host name or *.domain", v)
+	}
+	if _, _, err := net.SplitHostPort(dst); err != nil {
+		return fmt.Errorf("invalid sni route %q: %v", v, err)
+	}
+	if _, ok := r[name]; ok {
+		return fmt.Errorf("duplicate sni route %q", name)
+	}
+	r[name] = dst
+	return nil
+}
+
+// sniEnabled reports whether the server routes sni channels.
+func sniEnabled() bool {
+	return len(sniRoutes) > 0 || sniDefault != ""
+}
+
+// sniTarget returns the destination for a TLS server name.
+func sniTarget(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if dst, ok := sniRoutes[name]; ok && name != "" {
+		return dst, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if dst, ok := sniRoutes["*"+name[i:]]; ok {
+			return dst, nil
+		}
+	}
+	if sniDefault != "" {
+		return sniDefault, nil
+	}
+	if name == "" {
+		return "", fmt.Errorf("%w: no TLS server name and no -sni-default", errAuthRejected)
+	}
+	return "", fmt.Errorf("%w: no -sni route for %q", errAuthRejected, name)
+}
+
+var errNotTLS = errors.New("not a TLS client hello")
+
+// errHelloRead stops the handshake once the hello is read.
+var errHelloRead = errors.New("client hello read")
+
+// readServerName reads a TLS ClientHello from r and returns the server
+// name in it, which is empty when the client sent none. crypto/tls does
+// the parsing; the handshake is abandoned right after the hello.
+func readServerName(r io.Reader) (string, error) {
+	var name string
+	var seen bool
+	c := &helloConn{r: r}
+	err := tls.Server(c, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name, seen = hello.ServerName, true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	switch {
+	case seen:
+		return name, nil
+	case c.err != nil:
+		return "", c.err
+	}
+	return "", fmt.Errorf("%w: %v", errNotTLS, err)
+}
+
+// helloConn feeds the hello to crypto/tls and drops what it answers.
+type helloConn struct {
+	r   io.Reader
+	err error
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *helloConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *helloConn) Close() error                       { return nil }
+func (c *helloConn) LocalAddr() net.Addr                { return sniAddr{} }
+func (c *helloConn) RemoteAddr() net.Addr               { return sniAddr{} }
+func (c *helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c *helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sniAddr struct{}
+
+func (sniAddr) Network() string { return sniLabel }
+func (sniAddr) String() string  { return sniLabel }
+
+// sniConn is the local end of an sni channel. It holds what the client
+// sends until its ClientHello names a server, then dials the route for
+// that name and passes everything on; TLS itself is not terminated.
+type sniConn struct {
+	ctx context.Context
+	s   *session
+	pr  *io.PipeReader
+	pw  *io.PipeWriter
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	backend net.Conn
+	err     error
+	ready   chan struct{}
+	once    sync.Once
+}
+
+func newSNIConn(ctx context.Context, s *session) *sniConn {
+	pr, pw := io.Pipe()
+	c := &sniConn{ctx: ctx, s: s, pr: pr, pw: pw, ready: make(chan struct{})}
+	go c.route()
+	return c
+}
+
+func (c *sniConn) route() {
+	t := time.AfterFunc(sniTimeout, func() {
+		c.pw.CloseWithError(fmt.Errorf("%w: no client hello within %s", errTimeout, sniTimeout))
+	})
+	name, err := readServerName(c.pr)
+	t.Stop()
+	// later writes go to buf only.
+	c.pr.Close()
+	if err != nil && !errors.Is(err, errNotTLS) {
+		c.fail(err)
+		return
+	}
+	if err != nil {
+		c.s.logf("sni: %v", err)
+	}
+	dst, err := sniTarget(name)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	backend, err := dial(c.ctx, dst)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	c.s.logf("sni %q: dial:%s", name, dst)
+	if err := c.s.sendProxyHeader(backend); err != nil {
+		backend.Close()
+		c.fail(err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := backend.Write(c.buf.Bytes()); err != nil {
+		backend.Close()
+		c.setErr(err)
+		go c.s.fail(err)
+		return
+	}
+	c.buf.Reset()
+	c.backend = backend
+	c.once.Do(func() { close(c.ready) })
+}
+
+func (c *sniConn) fail(err error) {
+	c.s.logf("sni routing failed: %v", err)
+	c.mu.Lock()
+	c.setErr(err)
+	c.mu.Unlock()
+	c.s.fail(err)
+}
+
+// setErr records err and wakes Read. The caller should hold c.mu.
+func (c *sniConn) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.once.Do(func() { close(c.ready) })
+}
+
+// Write passes b on to the routed destination, holding it until then.
+func (c *sniConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, c.err
+	}
+	if c.backend != nil {
+		backend := c.backend
+		c.mu.Unlock()
+		return backend.Write(b)
+	}
+	c.buf.Write(b)
+	c.mu.Unlock()
+	// fails once the hello is read; buf has b for the destination.
+	c.pw.Write(b)
+	return len(b), nil
+}
+
+// Read reads from the routed destination once there is one.
+func (c *sniConn) Read(b []byte) (int, error) {
+	<-c.ready
+	c.mu.Lock()
+	backend, err := c.backend, c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return backend.Read(b)
+}
+
+func (c *sniConn) Close() error {
+	c.pr.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setErr(net.ErrClosed)
+	if c.backend != nil {
+		return c.backend.Close()
+	}
+	return nil
+}
+
+func (c *sniConn) LocalAddr() net.Addr                { return sniAddr{} }
+func (c *sniConn) RemoteAddr() net.Addr               { return sniAddr{} }
+func (c *sniConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sniConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sniConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first TLS record a client for name sends, of at
+// most TLS version max.
+func clientHello(t testing.TB, name string, max uint16) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: name, InsecureSkipVerify: name == "", MaxVersion: max}).Handshake()
+	defer client.Close()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(server, head); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(head, body...)
+}
+
+func TestReadServerName(t *testing.T) {
+	for _, max := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		for _, name := range []string{"git.example.com", ""} {
+			got, err := readServerName(bytes.NewReader(clientHello(t, name, max)))
+			if err != nil || got != name {
+				t.Errorf("hello for %q up to %#x: got %q, %v", name, max, got, err)
+			}
+		}
+	}
+}
+
+func FuzzReadServerName(f *testing.F) {
+	// TLS 1.2 hellos carry no key shares, which keeps the seeds short
+	f.Add(clientHello(f, "git.example.com", tls.VersionTLS12))
+	f.Add(clientHello(f, "", tls.VersionTLS12))
+	f.Add([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	f.Add([]byte{0x16, 0x03, 0x01, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		readServerName(bytes.NewReader(b))
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// soakOptions configure a soak run: conns tunnels opened at rate per
+// second, each echoing chunk sized round trips for duration.
+type soakOptions struct {
+	remote       string
+	conns        int
+	rate         float64
+	duration     time.Duration
+	setupTimeout time.Duration
+	chunk        int
+}
+
+// soakTunnel is the outcome of one soak tunnel.
+type soakTunnel struct {
+	setup time.Duration
+	bytes int64
+	trips int64
+	err   error
+}
+
+// soakSummary is the capacity planning report of a soak run.
+type soakSummary struct {
+	Tunnels      int            `json:"tunnels"`
+	Established  int            `json:"established"`
+	SuccessPct   float64        `json:"success_pct"`
+	SetupP50Ms   float64        `json:"setup_p50_ms"`
+	SetupP90Ms   float64        `json:"setup_p90_ms"`
+	SetupMaxMs   float64        `json:"setup_max_ms"`
+	Bytes        int64          `json:"bytes"`
+	RoundTrips   int64          `json:"round_trips"`
+	ThroughputMB float64        `json:"throughput_mb_s"`
+	Errors       map[string]int `json:"errors,omitempty"`
+	DurationSec  float64        `json:"duration_s"`
+}
+
+// soak runs opts.conns tunnels against the server. The destination must
+// echo what it receives; each tunnel sends a chunk and waits for it to
+// come back until its duration passed. It fails when no tunnel came up.
+func soak(ctx context.Context, key string, opts soakOptions, asJSON bool) error {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []soakTunnel
+	)
+	start := time.Now()
+	interval := time.Duration(float64(time.Second) / opts.rate)
+	for i := 0; i < opts.conns; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := soakOne(ctx, key, opts)
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	s := summarizeSoak(results, time.Since(start))
+	if asJSON {
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	} else {
+		fmt.Printf("tunnels      %d established of %d (%.1f%%)\n", s.Established, s.Tunnels, s.SuccessPct)
+		fmt.Printf("setup        p50 %.0fms  p90 %.0fms  max %.0fms\n", s.SetupP50Ms, s.SetupP90Ms, s.SetupMaxMs)
+		fmt.Printf("transferred  %d bytes in %d round trips, %.3f MB/s over %.1fs\n", s.Bytes, s.RoundTrips, s.ThroughputMB, s.DurationSec)
+		for msg, n := range s.Errors {
+			fmt.Printf("error        %dx %s\n", n, msg)
+		}
+	}
+	if s.Established == 0 {
+		return fmt.Errorf("%w: no soak tunnel established", errICEFailed)
+	}
+	return nil
+}
+
+// soakOne tunnels one end of a pipe and echoes chunks through the other.
+func soakOne(ctx context.Context, key string, opts soakOptions) soakTunnel {
+	local, sock := net.Pipe()
+	defer local.Close()
+	go connect(ctx, key, opts.remote, "", "", sock)
+	buf := make([]byte, opts.chunk)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	got := make([]byte, opts.chunk)
+	var r soakTunnel
+	begin := time.Now()
+	local.SetDeadline(begin.Add(opts.setupTimeout))
+	end := begin.Add(opts.setupTimeout + opts.duration)
+	for {
+		_, err := local.Write(buf)
+		if err == nil {
+			_, err = io.ReadFull(local, got)
+		}
+		if err != nil {
+			if r.trips == 0 {
+				err = fmt.Errorf("setup: %w", err)
+			}
+			r.err = err
+			return r
+		}
+		if r.trips == 0 {
+			r.setup = time.Since(begin)
+			end = time.Now().Add(opts.duration)
+		}
+		r.trips++
+		r.bytes += int64(2 * opts.chunk)
+		if time.Now().After(end) || ctx.Err() != nil {
+			return r
+		}
+		local.SetDeadline(time.Now().Add(opts.setupTimeout))
+	}
+}
+
+func summarizeSoak(results []soakTunnel, elapsed time.Duration) soakSummary {
+	s := soakSummary{Tunnels: len(results), DurationSec: elapsed.Seconds()}
+	var setups []time.Duration
+	for _, r := range results {
+		if r.trips > 0 {
+			s.Established++
+			setups = append(setups, r.setup)
+		}
+		s.Bytes += r.bytes
+		s.RoundTrips += r.trips
+		if r.err != nil {
+			if s.Errors == nil {
+				s.Errors = map[string]int{}
+			}
+			s.Errors[r.err.Error()]++
+		}
+	}
+	if s.Tunnels > 0 {
+		s.SuccessPct = 100 * float64(s.Established) / float64(s.Tunnels)
+	}
+	if len(setups) > 0 {
+		sort.Slice(setups, func(i, j int) bool { return setups[i] < setups[j] })
+		ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+		s.SetupP50Ms = ms(setups[len(setups)/2])
+		s.SetupP90Ms = ms(setups[len(setups)*9/10])
+		s.SetupMaxMs = ms(setups[len(setups)-1])
+	}
+	s.ThroughputMB = float64(s.Bytes) / 1e6 / elapsed.Seconds()
+	return s
+}
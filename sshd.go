@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// embeddedSSH is a minimal SSH server used instead of dialing -dial when
+// the server runs with -embedded-ssh. It only accepts public keys listed in
+// -authorized-keys and runs shell and exec requests without a pty.
+type embeddedSSH struct {
+	config *ssh.ServerConfig
+}
+
+func newEmbeddedSSH(hostKeyPath, authorizedKeysPath string) (*embeddedSSH, error) {
+	b, err := ioutil.ReadFile(authorizedKeysPath)
+	if err != nil {
+		return nil, err
+	}
+	authorized := map[string]bool{}
+	for len(b) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		authorized[string(key.Marshal())] = true
+		b = rest
+	}
+	if len(authorized) == 0 {
+		return nil, fmt.Errorf("%s: no authorized keys", authorizedKeysPath)
+	}
+	hostKey, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !authorized[string(key.Marshal())] {
+				return nil, fmt.Errorf("unknown public key for %q", c.User())
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"fp": ssh.FingerprintSHA256(key)}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	log.Println("embedded ssh host key:", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	return &embeddedSSH{config: config}, nil
+}
+
+// loadHostKey reads a PEM host key, generating an ECDSA one when missing.
+func loadHostKey(path string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		b = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			return nil, err
+		}
+		log.Println("embedded ssh host key generated:", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+// pipe starts an SSH server connection and returns the other end.
+func (e *embeddedSSH) pipe() net.Conn {
+	c1, c2 := net.Pipe()
+	go e.serve(c2)
+	return c1
+}
+
+func (e *embeddedSSH) serve(conn net.Conn) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, e.config)
+	if err != nil {
+		log.Println("embedded ssh handshake failed:", err)
+		return
+	}
+	log.Printf("embedded ssh login: %s (%s)", sconn.User(), sconn.Permissions.Extensions["fp"])
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			log.Println("embedded ssh accept failed:", err)
+			continue
+		}
+		go e.session(ch, reqs)
+	}
+}
+
+func (e *embeddedSSH) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	var env []string
+	started := false
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var v struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &v); err == nil {
+				env = append(env, v.Name+"="+v.Value)
+			}
+			req.Reply(true, nil)
+		case "shell", "exec":
+			if started {
+				req.Reply(false, nil)
+				continue
+			}
+			shell := os.Getenv("SHELL")
+			if shell == "" {
+				shell = "/bin/sh"
+			}
+			cmd := exec.Command(shell)
+			if req.Type == "exec" {
+				var v struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &v); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				cmd = exec.Command(shell, "-c", v.Command)
+			}
+			cmd.Env = append(os.Environ(), env...)
+			if err := e.run(ch, cmd); err != nil {
+				log.Println("embedded ssh:", err)
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+		default:
+			// pty-req, x11-req, subsystem... are not supported
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// run starts cmd wired to ch and reports its exit status when done.
+func (e *embeddedSSH) run(ch ssh.Channel, cmd *exec.Cmd) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	go func() {
+		var status uint32
+		if err := cmd.Wait(); err != nil {
+			status = 255
+			if ee, ok := err.(*exec.ExitError); ok {
+				if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+					status = uint32(ws.ExitStatus())
+				}
+			}
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		ch.Close()
+	}()
+	return nil
+}
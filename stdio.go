@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+)
+
+// stdioConn is the process's stdin and stdout as the local end of a
+// tunnel, for use as an ssh ProxyCommand.
+type stdioConn struct {
+	in, out *os.File
+}
+
+// newStdioConn takes over stdout for the tunnel. Anything else printing
+// there (pions/webrtc writes warnings with fmt) goes to stderr instead.
+func newStdioConn() stdioConn {
+	c := stdioConn{in: os.Stdin, out: os.Stdout}
+	os.Stdout = os.Stderr
+	return c
+}
+
+func (c stdioConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c stdioConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+
+// Close leaves stdin and stdout to the process exit.
+func (stdioConn) Close() error                       { return nil }
+func (stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// halfClose marks stdin EOF as the end of the sending direction only.
+func (stdioConn) halfClose() {}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// halfCloser is a local end whose EOF leaves the session up, relaying the
+// remote end until that closes. The data channel cannot carry the EOF to
+// the server.
+type halfCloser interface {
+	halfClose()
+}
+
+// connectStdio tunnels stdin and stdout to remote, returning when the
+// session ends or with the reason it did not open within timeout.
+func connectStdio(ctx context.Context, key, remote string, timeout time.Duration) error {
+	s, err := connect(ctx, key, remote, "", appHint, newStdioConn())
+	if err != nil {
+		return err
+	}
+	return s.wait(timeout)
+}
@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func newSyslog(tag string) (io.Writer, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{w}, nil
+}
+
+// syslogWriter logs each line at the severity logSeverity picks.
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (s syslogWriter) Write(b []byte) (int, error) {
+	msg := string(b)
+	var err error
+	switch logSeverity(msg) {
+	case severityErr:
+		err = s.w.Err(msg)
+	case severityWarning:
+		err = s.w.Warning(msg)
+	default:
+		err = s.w.Info(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,69 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSeverity(t *testing.T) {
+	for line, want := range map[string]int{
+		"relay listen: :9000":                                        severityInfo,
+		"forward=db session x max message size 2048":                 severityInfo,
+		"embedded ssh handshake failed: EOF":                         severityErr,
+		"rtc error: closed":                                          severityErr,
+		"forward db: paused, refusing 127.0.0.1:5000":                severityWarning,
+		"relay rejected: 192.0.2.1:40000":                            severityWarning,
+		"resolver failed, using system resolver: no such host":       severityWarning,
+		"WARNING: -tap writes tunneled data in the clear to x":       severityWarning,
+		"dial retry 1/3 in 1s: connection refused":                   severityWarning,
+		"session x: peer sends no keepalives, -stall-timeout is off": severityWarning,
+	} {
+		if got := logSeverity(line); got != want {
+			t.Errorf("%q: severity %d, want %d", line, got, want)
+		}
+	}
+}
+
+// TestSyslogPriority reads what syslogWriter sends to a stub syslog
+// socket: daemon facility, at the severity of each line.
+func TestSyslogPriority(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, err := syslog.Dial("unixgram", path, syslog.LOG_INFO|syslog.LOG_DAEMON, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	sw := syslogWriter{w}
+	for line, want := range map[string]syslog.Priority{
+		"server started":             syslog.LOG_INFO,
+		"offer refused: not allowed": syslog.LOG_WARNING,
+		"get failed: EOF":            syslog.LOG_ERR,
+	} {
+		if _, err := fmt.Fprintln(sw, line); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := fmt.Sprintf("<%d>", syslog.LOG_DAEMON|want)
+		if got := string(b[:n]); !strings.HasPrefix(got, prefix) || !strings.Contains(got, line) {
+			t.Errorf("%q sent as %q, want priority %s", line, got, prefix)
+		}
+	}
+}
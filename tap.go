@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tap directions
+const (
+	tapSend byte = 'S' // local socket to peer
+	tapRecv byte = 'R' // peer to local socket
+)
+
+// tap captures forwarded bytes to a file for debugging. Each record is
+//
+//	int64 unix nano | uint32 stream | byte direction | uint32 length | data
+//
+// in big endian. The file is rotated to FILE.1 when it exceeds max bytes.
+type tap struct {
+	path  string
+	max   int64
+	limit int64 // bytes captured per stream and direction, 0 = all
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	next uint32
+}
+
+var capture *tap
+
+func tapFlags(flags *flag.FlagSet) {
+	t := &tap{}
+	flags.StringVar(&t.path, "tap", "", "capture forwarded bytes to FILE (debug, records plaintext)")
+	flags.Int64Var(&t.limit, "tap-bytes", 0, "capture only the first N bytes per stream direction (0 = all)")
+	flags.Int64Var(&t.max, "tap-max", 64<<20, "rotate the capture after this many bytes")
+	capture = t
+}
+
+func openTap() {
+	if capture.path == "" {
+		capture = nil
+		return
+	}
+	log.Println("WARNING: -tap writes tunneled data in the clear to", capture.path)
+	if err := capture.open(); err != nil {
+		fatalConfig(err)
+	}
+}
+
+func (t *tap) open() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	t.f, t.size = f, 0
+	return nil
+}
+
+// stream allocates a stream id; nil when capturing is off.
+func (t *tap) stream() *tapStream {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	return &tapStream{t: t, id: t.next}
+}
+
+type tapStream struct {
+	t  *tap
+	id uint32
+
+	mu sync.Mutex
+	n  map[byte]int64
+}
+
+func (s *tapStream) record(dir byte, b []byte) {
+	if s == nil {
+		return
+	}
+	if s.t.limit > 0 {
+		s.mu.Lock()
+		if s.n == nil {
+			s.n = map[byte]int64{}
+		}
+		if rest := s.t.limit - s.n[dir]; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+		s.n[dir] += int64(len(b))
+		s.mu.Unlock()
+		if len(b) == 0 {
+			return
+		}
+	}
+	s.t.write(s.id, dir, b)
+}
+
+func (t *tap) write(id uint32, dir byte, b []byte) {
+	var h [17]byte
+	binary.BigEndian.PutUint64(h[0:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(h[8:], id)
+	h[12] = dir
+	binary.BigEndian.PutUint32(h[13:], uint32(len(b)))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return
+	}
+	if t.max > 0 && t.size+int64(len(h)+len(b)) > t.max {
+		t.f.Close()
+		t.f = nil
+		if err := os.Rename(t.path, t.path+".1"); err != nil {
+			log.Println("tap rotate failed:", err)
+		}
+		if err := t.open(); err != nil {
+			log.Println("tap rotate failed:", err)
+			return
+		}
+	}
+	t.f.Write(h[:])
+	t.f.Write(b)
+	t.size += int64(len(h) + len(b))
+}
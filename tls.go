@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// caReloadInterval is how often the signaling CA bundle is checked for
+// changes.
+var caReloadInterval = time.Minute
+
+var (
+	signalTLSCert string
+	signalTLSKey  string
+	signalingCA   string
+)
+
+// modTime returns the latest modification time of files.
+func modTime(files ...string) (time.Time, error) {
+	var t time.Time
+	for _, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+// certReloader serves a key pair from disk, loading it again when either
+// file changes so that renewed certificates apply without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	mod  time.Time
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A failed reload keeps
+// the previous certificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mod, err := modTime(r.certFile, r.keyFile)
+	if err == nil && mod.Equal(r.mod) {
+		return r.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err == nil {
+			if r.cert != nil {
+				log.Println("signaling certificate reloaded:", r.certFile)
+			}
+			r.mod, r.cert = mod, &cert
+			return r.cert, nil
+		}
+	}
+	if r.cert == nil {
+		return nil, err
+	}
+	log.Println("signaling certificate reload:", err)
+	r.mod = mod
+	return r.cert, nil
+}
+
+// caReloader verifies the signaling server against a CA bundle that is read
+// again every caReloadInterval when it changed.
+type caReloader struct {
+	file string
+
+	mu      sync.Mutex
+	checked time.Time
+	mod     time.Time
+	pool    *x509.CertPool
+}
+
+func (r *caReloader) roots() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pool != nil && time.Since(r.checked) < caReloadInterval {
+		return r.pool, nil
+	}
+	r.checked = time.Now()
+	mod, err := modTime(r.file)
+	if err == nil && mod.Equal(r.mod) {
+		return r.pool, nil
+	}
+	if err == nil {
+		var b []byte
+		if b, err = ioutil.ReadFile(r.file); err == nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				err = fmt.Errorf("%s: no certificates found", r.file)
+			} else {
+				if r.pool != nil {
+					log.Println("signaling CA bundle reloaded:", r.file)
+				}
+				r.mod, r.pool = mod, pool
+				return r.pool, nil
+			}
+		}
+	}
+	if r.pool == nil {
+		return nil, err
+	}
+	log.Println("signaling CA bundle reload:", err)
+	return r.pool, nil
+}
+
+// verify implements tls.Config.VerifyConnection against the current bundle.
+func (r *caReloader) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("signaling server sent no certificate")
+	}
+	roots, err := r.roots()
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// setupSignalingCA makes signaling requests trust only -signaling-ca.
+func setupSignalingCA() {
+	if signalingCA == "" {
+		return
+	}
+	r := &caReloader{file: signalingCA}
+	if _, err := r.roots(); err != nil {
+		fatalConfig(err)
+	}
+	signalingTransport().TLSClientConfig = &tls.Config{
+		// verify checks the chain itself against the reloaded bundle.
+		InsecureSkipVerify: true,
+		VerifyConnection:   r.verify,
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate for localhost, or a CA when signed by none.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, serial int64, ca *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "ssh-p2p test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeFile replaces name with b, dated at so that a reload sees it
+// changed even within the file system's time granularity.
+func writeFile(t *testing.T, name string, b []byte, at time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS accepts TLS connections with config until the test ends,
+// completing each handshake.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca := newTestCert(t, 1, nil)
+	old, renewed := newTestCert(t, 2, ca), newTestCert(t, 3, ca)
+	at := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, old.certPEM, at)
+	writeFile(t, keyFile, old.keyPEM, at)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, &tls.Config{GetCertificate: r.GetCertificate})
+	served := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := served(); got != 2 {
+		t.Fatalf("serial %d served, want 2", got)
+	}
+	at = at.Add(time.Second)
+	writeFile(t, certFile, renewed.certPEM, at)
+	writeFile(t, keyFile, renewed.keyPEM, at)
+	if got := served(); got != 3 {
+		t.Fatalf("serial %d served after the swap, want 3", got)
+	}
+	// a broken renewal keeps the last good certificate
+	writeFile(t, certFile, []byte("garbage"), at.Add(time.Second))
+	if got := served(); got != 3 {
+		t.Fatalf("serial %d served after a bad swap, want 3", got)
+	}
+}
+
+func TestCABundleSwap(t *testing.T) {
+	oldInterval := caReloadInterval
+	caReloadInterval = 0
+	t.Cleanup(func() { caReloadInterval = oldInterval })
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	oldCA, newCA := newTestCert(t, 1, nil), newTestCert(t, 2, nil)
+	oldLeaf, newLeaf := newTestCert(t, 3, oldCA), newTestCert(t, 4, newCA)
+	at := time.Now().Add(-time.Minute)
+	writeFile(t, bundle, oldCA.certPEM, at)
+	r := &caReloader{file: bundle}
+	if _, err := r.roots(); err != nil {
+		t.Fatal(err)
+	}
+	dial := func(leaf *testCert) error {
+		t.Helper()
+		cert, err := tls.X509KeyPair(leaf.certPEM, leaf.keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := serveTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true, VerifyConnection: r.verify})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial(oldLeaf); err != nil {
+		t.Fatalf("server of the bundled CA refused: %v", err)
+	}
+	if err := dial(newLeaf); err == nil {
+		t.Fatal("server of another CA trusted")
+	}
+	writeFile(t, bundle, newCA.certPEM, at.Add(time.Second))
+	if err := dial(newLeaf); err != nil {
+		t.Fatalf("server of the swapped in CA refused: %v", err)
+	}
+	if err := dial(oldLeaf); err == nil {
+		t.Fatal("server of the swapped out CA still trusted")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer exports OpenTelemetry spans of connection setup over OTLP/HTTP
+// with JSON encoding, configured by the standard OTEL_* environment
+// variables. Without an endpoint it stays nil and tracing costs nothing.
+var tracer *otlpTracer
+
+// Setup spans of a session, children of traceConnect. pions/webrtc v1.2.0
+// reports no DTLS event of its own, so traceHandshake covers the DTLS
+// handshake, the SCTP association and the data channel open.
+const (
+	traceConnect   = "connect"
+	traceGather    = "ice.gather"
+	traceSignaling = "signaling"
+	traceICE       = "ice.connect"
+	traceHandshake = "dtls.datachannel"
+)
+
+const (
+	traceBatch    = 64
+	traceQueue    = 1024
+	traceInterval = 5 * time.Second
+)
+
+type otlpTracer struct {
+	url     string
+	headers map[string]string
+	service string
+	spans   chan otlpSpan
+	client  *http.Client
+}
+
+// setupTrace turns tracing on when OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or
+// OTEL_EXPORTER_OTLP_ENDPOINT is set.
+func setupTrace() {
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "none" || os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+	if p := otelEnv("PROTOCOL"); p != "" && p != "http/json" && p != "http/protobuf" {
+		log.Printf("tracing off: OTLP protocol %s is not supported, only http/json", p)
+		return
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		fatalConfig(fmt.Errorf("OTLP endpoint: %v", err))
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "ssh-p2p"
+	}
+	timeout := 10 * time.Second
+	if ms, err := strconv.Atoi(otelEnv("TIMEOUT")); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	tracer = &otlpTracer{
+		url:     endpoint,
+		headers: otelHeaders(otelEnv("HEADERS")),
+		service: service,
+		spans:   make(chan otlpSpan, traceQueue),
+		client:  &http.Client{Timeout: timeout},
+	}
+	go tracer.run()
+	log.Println("tracing to", endpoint)
+}
+
+// otelEnv returns the traces specific OTEL_EXPORTER_OTLP_TRACES_name, or
+// else the general OTEL_EXPORTER_OTLP_name.
+func otelEnv(name string) string {
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_" + name); v != "" {
+		return v
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+}
+
+// otelHeaders parses a "key=value,key=value" list, values URL encoded.
+func otelHeaders(s string) map[string]string {
+	h := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(kv[i+1:]))
+		if err != nil {
+			v = kv[i+1:]
+		}
+		h[strings.TrimSpace(kv[:i])] = v
+	}
+	return h
+}
+
+// export queues span without waiting, dropping it when the queue is full.
+func (t *otlpTracer) export(span otlpSpan) {
+	select {
+	case t.spans <- span:
+	default:
+	}
+}
+
+// run sends the queued spans in batches.
+func (t *otlpTracer) run() {
+	tick := time.NewTicker(traceInterval)
+	defer tick.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < traceBatch {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.post(batch); err != nil {
+			log.Printf("tracing: dropped %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+func (t *otlpTracer) post(spans []otlpSpan) error {
+	b, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttr{stringAttr("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "ssh-p2p"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", t.url, res.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of an export request: ids are hex, times
+// nanoseconds since the epoch as decimal strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string      `json:"traceId"`
+		SpanID       string      `json:"spanId"`
+		ParentSpanID string      `json:"parentSpanId,omitempty"`
+		Name         string      `json:"name"`
+		Kind         int         `json:"kind"`
+		Start        string      `json:"startTimeUnixNano"`
+		End          string      `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr  `json:"attributes,omitempty"`
+		Status       *otlpStatus `json:"status,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanStatusOK     = 1
+	spanStatusError  = 2
+)
+
+func stringAttr(key, value string) otlpAttr {
+	a := otlpAttr{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+func traceID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// sessionTrace collects the setup phases of a session, exported as spans
+// once the data channel opened or the session closed.
+type sessionTrace struct {
+	mu     sync.Mutex
+	trace  string
+	root   string
+	parent string
+	start  time.Time
+	phases map[string][2]time.Time
+	done   bool
+}
+
+func newSessionTrace(start time.Time) *sessionTrace {
+	if tracer == nil {
+		return nil
+	}
+	return &sessionTrace{trace: traceID(16), root: traceID(8), start: start, phases: map[string][2]time.Time{}}
+}
+
+// begin and end time a phase; nil receivers do nothing.
+func (t *sessionTrace) begin(phase string) { t.set(phase, 0, time.Now()) }
+func (t *sessionTrace) end(phase string)   { t.set(phase, 1, time.Now()) }
+
+func (t *sessionTrace) set(phase string, i int, at time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.phases[phase]
+	if i == 1 && p[0].IsZero() || !p[i].IsZero() {
+		return
+	}
+	p[i] = at
+	t.phases[phase] = p
+}
+
+// span records a phase that is already over.
+func (t *sessionTrace) span(phase string, start, end time.Time) {
+	t.set(phase, 0, start)
+	t.set(phase, 1, end)
+}
+
+// traceparent returns the W3C trace context of the session's root span,
+// which a client sends the server so that both sides join one trace.
+func (t *sessionTrace) traceparent() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return "00-" + t.trace + "-" + t.root + "-01"
+}
+
+// join continues the trace of the peer's traceparent, if valid.
+func (t *sessionTrace) join(traceparent string) {
+	p := strings.Split(traceparent, "-")
+	if t == nil || len(p) != 4 || p[0] != "00" || len(p[1]) != 32 || len(p[2]) != 16 {
+		return
+	}
+	if _, err := hex.DecodeString(p[1] + p[2]); err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.trace, t.parent = p[1], p[2]
+	t.mu.Unlock()
+}
+
+// finishTrace exports the trace of s once; err is why setup failed, if it did.
+func (s *session) finishTrace(err error) {
+	t := s.trace
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	now := time.Now()
+	s.mu.Lock()
+	attrs := []otlpAttr{stringAttr("ssh_p2p.session.id", s.id)}
+	if s.forward != "" {
+		attrs = append(attrs, stringAttr("ssh_p2p.forward", s.forward))
+	}
+	if s.target != "" {
+		attrs = append(attrs, stringAttr("ssh_p2p.target", s.target))
+	}
+	s.mu.Unlock()
+	kind := spanKindClient
+	if t.parent != "" {
+		kind = spanKindServer
+	}
+	status := &otlpStatus{Code: spanStatusOK}
+	if err != nil {
+		status = &otlpStatus{Code: spanStatusError, Message: err.Error()}
+	}
+	tracer.export(otlpSpan{
+		TraceID: t.trace, SpanID: t.root, ParentSpanID: t.parent,
+		Name: traceConnect, Kind: kind,
+		Start: unixNano(t.start), End: unixNano(now),
+		Attributes: attrs, Status: status,
+	})
+	for name, p := range t.phases {
+		if p[1].IsZero() {
+			// cut short by the failure
+			p[1] = now
+		}
+		tracer.export(otlpSpan{
+			TraceID: t.trace, SpanID: traceID(8), ParentSpanID: t.root,
+			Name: name, Kind: spanKindInternal,
+			Start: unixNano(p[0]), End: unixNano(p[1]),
+			Attributes: attrs,
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nobonobo/ssh-p2p/signaling"
+	"github.com/pions/webrtc"
+)
+
+var testSeed = flag.Int64("seed", 1, "seed of the randomized tunnel tests")
+
+// withSignaling points the peers at an in-process signaling server for
+// the test, with no STUN servers to wait for. The server answers offers,
+// as it does by default; eachRole picks which peer sends the offer.
+func withSignaling(t *testing.T, h http.Handler) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	oldURL, oldRTC, oldAccept := signalingURL, defaultRTCConfiguration, acceptOffers
+	signalingURL, defaultRTCConfiguration, acceptOffers = ts.URL, webrtc.RTCConfiguration{}, true
+	t.Cleanup(func() {
+		closeSessions()
+		signalingURL, defaultRTCConfiguration, acceptOffers = oldURL, oldRTC, oldAccept
+		ts.Close()
+	})
+	return ts
+}
+
+// eachRole runs f once with the client sending the offer, the default,
+// and once with the client asking the server for it, as with -answerer.
+func eachRole(t *testing.T, f func(t *testing.T)) {
+	for _, c := range []struct {
+		name string
+		ask  bool
+	}{
+		{"client offers", false},
+		{"server offers", true},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			old := askOffer
+			askOffer = c.ask
+			t.Cleanup(func() { askOffer = old })
+			f(t)
+		})
+	}
+}
+
+// startServer serves the room key, dialing addr, until the test ends.
+func startServer(t *testing.T, key, addr string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serve(ctx, key, addr)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// dialTunnel returns the local end of a tunnel to the server of key.
+func dialTunnel(t *testing.T, key string) net.Conn {
+	t.Helper()
+	local, sock := net.Pipe()
+	go connect(context.Background(), key, "", "", "", sock)
+	t.Cleanup(func() { local.Close() })
+	return local
+}
+
+// echoServer echoes every connection, as handle passes it on.
+func echoServer(t *testing.T, handle func(net.Conn) io.ReadWriter) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rw := io.ReadWriter(conn)
+				if handle != nil {
+					rw = handle(conn)
+				}
+				io.Copy(rw, rw)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// lagConn delays each read of a connection by up to max.
+type lagConn struct {
+	net.Conn
+	mu  sync.Mutex
+	rnd *rand.Rand
+	max time.Duration
+}
+
+func (c *lagConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	d := time.Duration(c.rnd.Int63n(int64(c.max)))
+	c.mu.Unlock()
+	time.Sleep(d)
+	return c.Conn.Read(b)
+}
+
+// TestInterleavedForwards pushes random data in random sized chunks
+// through concurrent tunnels to an echo server that lags, and checks each
+// stream comes back whole and in order. -seed picks the data. Each stream
+// keeps one chunk in flight: pions/webrtc v1.2.0 has no retransmission
+// timer, so a burst overflowing the receiver's UDP buffer is lost.
+func TestInterleavedForwards(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets up real peer connections")
+	}
+	if raceEnabled {
+		t.Skip("pions/dtls v1.0.2 races in its own handshake")
+	}
+	eachRole(t, func(t *testing.T) {
+		const (
+			streams = 8
+			size    = 256 << 10
+		)
+		t.Logf("seed %d", *testSeed)
+		var mu sync.Mutex
+		lag := rand.New(rand.NewSource(*testSeed))
+		withSignaling(t, (&signaling.Server{}).Handler())
+		key := room(uuid.New().String())
+		startServer(t, key, echoServer(t, func(conn net.Conn) io.ReadWriter {
+			mu.Lock()
+			defer mu.Unlock()
+			return &lagConn{Conn: conn, rnd: rand.New(rand.NewSource(lag.Int63())), max: 5 * time.Millisecond}
+		}))
+		var wg sync.WaitGroup
+		for i := 0; i < streams; i++ {
+			i := i
+			rnd := rand.New(rand.NewSource(*testSeed + int64(i)))
+			data := make([]byte, size)
+			rnd.Read(data)
+			conn := dialTunnel(t, key)
+			conn.SetDeadline(time.Now().Add(60 * time.Second))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got := make([]byte, size)
+				for off := 0; off < size; {
+					n := 1 + rnd.Intn(32<<10)
+					if n > size-off {
+						n = size - off
+					}
+					if _, err := conn.Write(data[off : off+n]); err != nil {
+						t.Errorf("stream %d: write: %v", i, err)
+						return
+					}
+					if _, err := io.ReadFull(conn, got[off:off+n]); err != nil {
+						t.Errorf("stream %d: read: %v", i, err)
+						return
+					}
+					off += n
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("stream %d: %s", i, firstDiff(got, data))
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+// roundRobin spreads requests over backends in turn, without affinity.
+func roundRobin(backends ...http.Handler) http.Handler {
+	var mu sync.Mutex
+	var next int
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := backends[next%len(backends)]
+		next++
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// statusWriter keeps the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// TestLoadBalancedSignaling sets up tunnels through two signaling
+// backends with separate stores: a push landing on the backend nobody
+// pulls on must be retried until it reaches the puller's.
+func TestLoadBalancedSignaling(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets up real peer connections")
+	}
+	eachRole(t, func(t *testing.T) {
+		var misses int64
+		var mu sync.Mutex
+		backend := func() http.Handler {
+			h := (&signaling.Server{}).Handler()
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+				h.ServeHTTP(sw, r)
+				if sw.code == http.StatusNotFound {
+					mu.Lock()
+					misses++
+					mu.Unlock()
+				}
+			})
+		}
+		withSignaling(t, roundRobin(backend(), backend()))
+		key := room(uuid.New().String())
+		startServer(t, key, echoServer(t, nil))
+		for i := 0; i < 3; i++ {
+			conn := dialTunnel(t, key)
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatalf("tunnel %d: %v", i, err)
+			}
+			conn.Close()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if misses == 0 {
+			t.Fatal("no push reached the backend without the puller")
+		}
+	})
+}
+
+// firstDiff describes where got first differs from want.
+func firstDiff(got, want []byte) string {
+	for i := range want {
+		if got[i] != want[i] {
+			return fmt.Sprintf("byte %d is %#x, want %#x", i, got[i], want[i])
+		}
+	}
+	return "equal"
+}
@@ -0,0 +1,134 @@
+//go:build vault
+// +build vault
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vault reads the connection key from a Vault KV secret instead of -key.
+// The token comes from VAULT_TOKEN.
+var vault struct {
+	addr    string
+	path    string
+	field   string
+	refresh time.Duration
+	key     *string
+	client  http.Client
+}
+
+func vaultFlags(flags *flag.FlagSet, key *string) {
+	vault.key = key
+	flags.StringVar(&vault.addr, "vault-addr", os.Getenv("VAULT_ADDR"), "Vault server URL")
+	flags.StringVar(&vault.path, "vault-path", "", "read the key from this Vault secret, e.g. secret/data/ssh-p2p (token from VAULT_TOKEN)")
+	flags.StringVar(&vault.field, "vault-field", "key", "field of -vault-path holding the key")
+	flags.DurationVar(&vault.refresh, "vault-refresh", 5*time.Minute, "re-read -vault-path this often and exit when the key changed (0 = never)")
+}
+
+// setupVault replaces the key with the one stored in Vault and keeps the
+// token renewed. A rotated key makes the process exit so that its
+// supervisor restarts it with the new one.
+func setupVault() {
+	if vault.path == "" {
+		return
+	}
+	vault.client.Timeout = 30 * time.Second
+	key, err := vaultKey()
+	if err != nil {
+		fatalConfig("vault:", err)
+	}
+	*vault.key = key
+	log.Println("vault: key read from", vault.path)
+	go renewVaultToken()
+	if vault.refresh > 0 {
+		go watchVaultKey(key)
+	}
+}
+
+// vaultRequest calls the Vault API, decoding the response into v.
+func vaultRequest(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(vault.addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := vault.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// vaultKey reads the key field of a KV version 1 or 2 secret.
+func vaultKey() (string, error) {
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := vaultRequest("GET", vault.path, &secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner // KV version 2
+	}
+	key, ok := data[vault.field].(string)
+	if !ok || key == "" {
+		return "", fmt.Errorf("%s has no %q field", vault.path, vault.field)
+	}
+	return key, nil
+}
+
+func watchVaultKey(key string) {
+	for range time.Tick(vault.refresh) {
+		v, err := vaultKey()
+		if err != nil {
+			log.Println("vault:", err)
+			continue
+		}
+		if v != key {
+			log.Println("vault: key rotated, exiting to restart with it")
+			closeSessions()
+			os.Exit(exitKeyRotated)
+		}
+	}
+}
+
+// renewVaultToken renews a renewable token at half its TTL.
+func renewVaultToken() {
+	for {
+		var self struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := vaultRequest("GET", "auth/token/lookup-self", &self); err != nil {
+			log.Println("vault: token lookup:", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		if !self.Data.Renewable || self.Data.TTL <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(self.Data.TTL) * time.Second / 2)
+		var renewed struct{}
+		if err := vaultRequest("POST", "auth/token/renew-self", &renewed); err != nil {
+			log.Println("vault: token renewal:", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		log.Println("vault: token renewed")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !vault
+// +build !vault
+
+package main
+
+import "flag"
+
+// Vault support is built with -tags vault.
+func vaultFlags(flags *flag.FlagSet, key *string) {}
+
+func setupVault() {}
@@ -0,0 +1,78 @@
+//go:build vault
+// +build vault
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// withVault points vault at a stub server answering secret reads with
+// body.
+func withVault(t *testing.T, body string) {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/ssh-p2p" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	old := vault
+	vault.addr, vault.path, vault.field = ts.URL, "secret/ssh-p2p", "key"
+	t.Cleanup(func() {
+		vault = old
+		ts.Close()
+	})
+}
+
+func TestVaultKey(t *testing.T) {
+	for _, c := range []struct {
+		name, body, want string
+	}{
+		{"kv1", `{"data":{"key":"one"}}`, "one"},
+		{"kv2", `{"data":{"data":{"key":"two"},"metadata":{}}}`, "two"},
+		{"missing field", `{"data":{"other":"x"}}`, ""},
+		{"empty", `{"data":{"key":""}}`, ""},
+	} {
+		withVault(t, c.body)
+		key, err := vaultKey()
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%s: got key %q, want an error", c.name, key)
+			}
+			continue
+		}
+		if err != nil || key != c.want {
+			t.Errorf("%s: got %q, %v, want %q", c.name, key, err, c.want)
+		}
+	}
+}
+
+// TestVaultKeyRotationExits runs watchVaultKey in a subprocess against a
+// secret holding another key, which must exit with exitKeyRotated.
+func TestVaultKeyRotationExits(t *testing.T) {
+	if os.Getenv("SSH_P2P_TEST_VAULT") != "" {
+		withVault(t, `{"data":{"key":"rotated"}}`)
+		vault.refresh = 10 * time.Millisecond
+		watchVaultKey("old")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestVaultKeyRotationExits$")
+	cmd.Env = append(os.Environ(), "SSH_P2P_TEST_VAULT=1")
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitKeyRotated {
+		t.Fatalf("got %v, want exit status %d\n%s", err, exitKeyRotated, out)
+	}
+}
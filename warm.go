@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// warmRetryInterval paces rebuilding a pre-warmed connection that dropped.
+var warmRetryInterval = 5 * time.Second
+
+// warmConn stands in for a local connection while its tunnel is set up
+// ahead of time. Data arriving from the server is buffered until use hands
+// over the real connection.
+type warmConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	ready  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newWarmConn() *warmConn {
+	return &warmConn{ready: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// use attaches the real connection, reporting false when the tunnel is
+// already gone.
+func (c *warmConn) use(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	if _, err := conn.Write(c.buf.Bytes()); err != nil {
+		conn.Close()
+		go c.Close()
+		return true
+	}
+	c.buf.Reset()
+	c.Conn = conn
+	close(c.ready)
+	return true
+}
+
+// attached returns the real connection, nil before use.
+func (c *warmConn) attached() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn
+}
+
+func (c *warmConn) LocalAddr() net.Addr {
+	if conn := c.attached(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return warmAddr{}
+}
+
+func (c *warmConn) RemoteAddr() net.Addr {
+	if conn := c.attached(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return warmAddr{}
+}
+
+// warmAddr stands for the local connection a pre-warmed tunnel waits for.
+type warmAddr struct{}
+
+func (warmAddr) Network() string { return "warm" }
+func (warmAddr) String() string  { return "pre-warmed" }
+
+// Deadlines apply once the real connection is attached. Before that a
+// write only fills the buffer, so it cannot block.
+func (c *warmConn) SetDeadline(t time.Time) error {
+	if conn := c.attached(); conn != nil {
+		return conn.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *warmConn) SetReadDeadline(t time.Time) error {
+	if conn := c.attached(); conn != nil {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *warmConn) SetWriteDeadline(t time.Time) error {
+	if conn := c.attached(); conn != nil {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (c *warmConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.ready:
+		return c.Conn.Read(b)
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+func (c *warmConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	conn := c.Conn
+	if conn == nil {
+		defer c.mu.Unlock()
+		return c.buf.Write(b)
+	}
+	c.mu.Unlock()
+	return conn.Write(b)
+}
+
+func (c *warmConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	c.mu.Lock()
+	conn := c.Conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// prewarm keeps one tunnel established ahead of the next local connection,
+// rebuilding it when it drops before use.
+func (f *forward) prewarm(ctx context.Context, key string) {
+	for {
+		w := newWarmConn()
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			return
+		}
+		f.warm = w
+		f.mu.Unlock()
+		go f.tunnel(ctx, key, w)
+		select {
+		case <-w.ready:
+			continue
+		case <-w.closed:
+			log.Println("pre-warmed connection dropped:", f.listen)
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-time.After(warmRetryInterval + retries.spend()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// takeWarm hands conn to the pre-warmed tunnel, if one is up.
+func (f *forward) takeWarm(conn net.Conn) bool {
+	f.mu.Lock()
+	w := f.warm
+	f.warm = nil
+	f.mu.Unlock()
+	return w != nil && w.use(conn)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nobonobo/ssh-p2p/signaling"
+	"github.com/pions/webrtc"
+	"github.com/pions/webrtc/pkg/datachannel"
+	"github.com/pions/webrtc/pkg/ice"
+)
+
+// stallTimeout and stallAction configure the stall watchdog: when a
+// connected session received nothing, not even a keepalive, for
+// stallTimeout, the path is taken to be a black hole that ICE did not
+// notice.
+var (
+	stallTimeout time.Duration
+	stallAction  = "reconnect"
+)
+
+// stallActions are the -stall-action values. pions/webrtc v1.2.0 cannot
+// restart ICE on a live PeerConnection, so a stalled session is either
+// dropped (the next local connection negotiates a new one) or the process
+// exits for its supervisor to restart it.
+var stallActions = map[string]bool{"reconnect": true, "exit": true}
+
+// keepaliveInterval is asked of the peer by a side without -stall-timeout,
+// only to tell it keepalives are understood.
+const keepaliveInterval = 15 * time.Second
+
+// minKeepaliveInterval is the least interval keepalives are sent at,
+// whatever a peer asks for.
+const minKeepaliveInterval = 100 * time.Millisecond
+
+// keepaliveWanted is the interval this side asks the peer to send
+// keepalives at, in milliseconds: a quarter of -stall-timeout, so that a
+// few can be lost before the watchdog fires.
+func keepaliveWanted() int64 {
+	d := keepaliveInterval
+	if stallTimeout > 0 {
+		d = stallTimeout / 4
+	}
+	if d < minKeepaliveInterval {
+		d = minKeepaliveInterval
+	}
+	return int64(d / time.Millisecond)
+}
+
+// stallWatch tracks when a session last heard from its peer.
+type stallWatch struct {
+	mu       sync.Mutex
+	heard    time.Time
+	spoke    time.Time
+	interval time.Duration // the peer's keepalive interval, 0 = none
+
+	// sending serializes data and keepalive messages.
+	sending sync.Mutex
+}
+
+// keepalive records the keepalive interval the peer asked for in v; a
+// peer asking none predates keepalives.
+func (w *stallWatch) keepalive(v signaling.ConnectInfo) {
+	if v.Keepalive <= 0 {
+		return
+	}
+	d := time.Duration(v.Keepalive) * time.Millisecond
+	if d < minKeepaliveInterval {
+		d = minKeepaliveInterval
+	}
+	w.mu.Lock()
+	w.interval = d
+	w.mu.Unlock()
+}
+
+// peerInterval returns the keepalive interval the peer asked for.
+func (w *stallWatch) peerInterval() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.interval
+}
+
+func (w *stallWatch) sent() {
+	w.mu.Lock()
+	w.spoke = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *stallWatch) received() {
+	w.mu.Lock()
+	w.heard = time.Now()
+	w.mu.Unlock()
+}
+
+// silent reports for how long nothing was received.
+func (w *stallWatch) silent() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Since(w.heard)
+}
+
+// idle reports for how long nothing was sent.
+func (w *stallWatch) idle() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Since(w.spoke)
+}
+
+// isKeepalive reports whether a received message is a keepalive: one of
+// text, from a peer that asked for keepalives. Such peers send data as
+// binary; browsers, which send strings as text, ask for none.
+func isKeepalive(s *session, payload datachannel.Payload) bool {
+	_, text := payload.(*datachannel.PayloadString)
+	return text && s.stall.peerInterval() > 0
+}
+
+// keepaliveMessage is what a keepalive is on the data channel: a text
+// message without data, sent by pions/webrtc as PPID 56 (WebRTC String
+// Empty).
+var keepaliveMessage = datachannel.PayloadString{}
+
+// sendKeepalives sends an empty text message over dc whenever nothing was
+// sent for the interval the peer asked for, until s closes. Peers that
+// did not ask get none.
+func sendKeepalives(s *session, dc *webrtc.RTCDataChannel) {
+	d := s.stall.peerInterval()
+	if d <= 0 {
+		return
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		if s.stall.idle() < d {
+			continue
+		}
+		s.stall.sending.Lock()
+		err := dc.Send(keepaliveMessage)
+		s.stall.sending.Unlock()
+		if err != nil {
+			s.logf("keepalive failed: %v", err)
+			return
+		}
+		s.stall.sent()
+	}
+}
+
+// watchStall applies action, the -stall-action, to s once it received
+// nothing for timeout, the -stall-timeout, until s closes. Each side sends
+// keepalives while it has nothing else to send, so a quiet or one-way
+// stream is not a stall.
+func watchStall(s *session, timeout time.Duration, action string) {
+	if timeout <= 0 {
+		return
+	}
+	if s.stall.peerInterval() <= 0 {
+		s.logf("session %s: peer sends no keepalives, -stall-timeout is off for it", s.id)
+		return
+	}
+	s.stall.received() // the channel just opened
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		d := s.stall.silent()
+		if d < timeout {
+			continue
+		}
+		err := fmt.Errorf("%w: session %s stalled, nothing received for %s", errICEFailed, s.id, d.Round(time.Second))
+		if action == "exit" {
+			fatal(err)
+		}
+		s.logf("%v", err)
+		s.fail(err)
+		return
+	}
+}
+
+// iceDisconnectTimeout is how long a session may stay ICE disconnected,
+// for the agent to find its way back to connected, before it fails.
+// pions/webrtc v1.2.0 reports disconnected after 30s without any packet
+// on the selected pair and has no failed state of its own.
+var iceDisconnectTimeout = 5 * time.Second
+
+// iceWatch fails s once ICE stayed disconnected for iceDisconnectTimeout.
+type iceWatch struct {
+	mu    sync.Mutex
+	grace *time.Timer
+}
+
+func (w *iceWatch) update(s *session, state ice.ConnectionState) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch state {
+	case ice.ConnectionStateDisconnected:
+		if iceDisconnectTimeout <= 0 {
+			s.fail(errICEFailed)
+			return
+		}
+		if w.grace == nil {
+			s.logf("session %s ice disconnected, failing in %s unless it reconnects", s.id, iceDisconnectTimeout)
+			w.grace = time.AfterFunc(iceDisconnectTimeout, func() { s.fail(errICEFailed) })
+		}
+	case ice.ConnectionStateConnected:
+		if w.grace != nil {
+			w.grace.Stop()
+			w.grace = nil
+			s.logf("session %s ice reconnected", s.id)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nobonobo/ssh-p2p/signaling"
+	"github.com/pions/webrtc"
+	"github.com/pions/webrtc/pkg/datachannel"
+)
+
+func withStallTimeout(t *testing.T, d time.Duration) {
+	t.Helper()
+	oldTimeout, oldAction := stallTimeout, stallAction
+	stallTimeout, stallAction = d, "reconnect"
+	t.Cleanup(func() { stallTimeout, stallAction = oldTimeout, oldAction })
+}
+
+// watchedSession returns a session whose peer asked for keepalives every
+// interval, watched for stalls.
+func watchedSession(t *testing.T, interval time.Duration) *session {
+	t.Helper()
+	pc, err := webrtc.New(webrtc.RTCConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSession(uuid.New().String(), pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.stall.keepalive(signaling.ConnectInfo{Keepalive: int64(interval / time.Millisecond)})
+	go watchStall(s, stallTimeout, stallAction)
+	return s
+}
+
+// TestWatchStallBlackHole drops a session once nothing, data or
+// keepalive, arrives any more.
+func TestWatchStallBlackHole(t *testing.T) {
+	withStallTimeout(t, 200*time.Millisecond)
+	s := watchedSession(t, 50*time.Millisecond)
+	select {
+	case <-s.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("black holed session not dropped")
+	}
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if !errors.Is(err, errICEFailed) {
+		t.Fatalf("got %v, want ice failed", err)
+	}
+}
+
+// TestWatchStallKeepalives keeps a session that sends nothing but gets
+// keepalives.
+func TestWatchStallKeepalives(t *testing.T) {
+	withStallTimeout(t, 200*time.Millisecond)
+	s := watchedSession(t, 50*time.Millisecond)
+	s.stall.sent()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case <-s.done:
+			t.Fatal("session getting keepalives dropped")
+		case <-deadline:
+			return
+		case <-time.After(50 * time.Millisecond):
+			s.stall.received()
+		}
+	}
+}
+
+func TestWatchStallOldPeer(t *testing.T) {
+	withStallTimeout(t, 100*time.Millisecond)
+	s := watchedSession(t, 0)
+	select {
+	case <-s.done:
+		t.Fatal("session of a peer without keepalives dropped")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestIsKeepalive(t *testing.T) {
+	s := &session{}
+	text, binary := &datachannel.PayloadString{Data: []byte{0}}, &datachannel.PayloadBinary{Data: []byte{0}}
+	if isKeepalive(s, text) {
+		t.Fatal("text of a peer that asked for no keepalives taken for one")
+	}
+	s.stall.keepalive(signaling.ConnectInfo{Keepalive: 1})
+	if got := s.stall.peerInterval(); got != minKeepaliveInterval {
+		t.Fatalf("interval %s, want at least %s", got, minKeepaliveInterval)
+	}
+	if !isKeepalive(s, text) {
+		t.Fatal("keepalive not recognized")
+	}
+	if isKeepalive(s, binary) {
+		t.Fatal("binary data taken for a keepalive")
+	}
+}
+
+// TestKeepaliveWire pins the keepalive a browser peer receives, and must
+// send when it asked for keepalives: a text message without data.
+func TestKeepaliveWire(t *testing.T) {
+	if keepaliveMessage.PayloadType() != datachannel.PayloadTypeString || len(keepaliveMessage.Data) != 0 {
+		t.Fatalf("keepalive %#v, want an empty text message", keepaliveMessage)
+	}
+	s := &session{}
+	s.stall.keepalive(signaling.ConnectInfo{Keepalive: 15000})
+	for _, p := range []datachannel.Payload{&datachannel.PayloadString{}, &datachannel.PayloadString{Data: []byte{0}}} {
+		if !isKeepalive(s, p) {
+			t.Errorf("%#v not taken for a keepalive", p)
+		}
+	}
+}
+
+// TestTextPayload checks text messages, which browsers send for strings,
+// carry stream bytes exactly as binary ones do, as long as the sender
+// asked for no keepalives.
+func TestTextPayload(t *testing.T) {
+	s := &session{}
+	want := []byte("ls -l\r\xff\x00")
+	for _, p := range []datachannel.Payload{&datachannel.PayloadString{Data: want}, &datachannel.PayloadBinary{Data: want}} {
+		if isKeepalive(s, p) {
+			t.Errorf("%#v taken for a keepalive", p)
+			continue
+		}
+		if got, ok := messageData(p); !ok || string(got) != string(want) {
+			t.Errorf("%#v carries %q, want %q", p, got, want)
+		}
+	}
+}
+
+// TestOneWayStreamNotStalled sends data through a tunnel whose far end
+// never replies, for several -stall-timeout periods.
+func TestOneWayStreamNotStalled(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets up real peer connections")
+	}
+	eachRole(t, func(t *testing.T) {
+		withStallTimeout(t, time.Second)
+		withSignaling(t, (&signaling.Server{}).Handler())
+		key := room(uuid.New().String())
+		startServer(t, key, echoServer(t, func(conn net.Conn) io.ReadWriter {
+			return struct {
+				io.Reader
+				io.Writer
+			}{conn, ioutil.Discard}
+		}))
+		conn := dialTunnel(t, key)
+		conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		for end := time.Now().Add(3 * stallTimeout); time.Now().Before(end); time.Sleep(100 * time.Millisecond) {
+			if _, err := conn.Write(make([]byte, 1024)); err != nil {
+				t.Fatalf("one-way stream dropped: %v", err)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		if err, ok := err.(net.Error); !ok || !err.Timeout() {
+			t.Fatalf("one-way stream dropped: %v", err)
+		}
+	})
+}
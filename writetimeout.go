@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// writeTimeout is -write-timeout: how long a write to the data channel or
+// the local connection may go without progress before the session is
+// taken to be stuck and closed (0 = never). A throttled write that keeps
+// making progress, as when the local end reads slowly, does not count.
+var writeTimeout time.Duration
+
+// writeWatch tracks the data channel send in progress. pions/webrtc v1.2.0
+// queues sends without flow control, so one only blocks when it is wedged.
+type writeWatch struct {
+	mu    sync.Mutex
+	since time.Time
+}
+
+func (w *writeWatch) start() {
+	w.mu.Lock()
+	w.since = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *writeWatch) done() {
+	w.mu.Lock()
+	w.since = time.Time{}
+	w.mu.Unlock()
+}
+
+// blocked reports for how long the send in progress has been blocked.
+func (w *writeWatch) blocked() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.since.IsZero() {
+		return 0
+	}
+	return time.Since(w.since)
+}
+
+// watchWrites closes s once a data channel send blocked for -write-timeout,
+// until s closes. The blocked send itself cannot be interrupted.
+func watchWrites(s *session) {
+	if writeTimeout <= 0 {
+		return
+	}
+	t := time.NewTicker(writeTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		if d := s.write.blocked(); d >= writeTimeout {
+			err := fmt.Errorf("%w: session %s stuck, a data channel write blocked for %s", errTimeout, s.id, d.Round(time.Second))
+			s.logf("%v", err)
+			s.fail(err)
+			return
+		}
+	}
+}
+
+// writeLocal writes b to the local end conn, failing when a write makes no
+// progress for -write-timeout.
+func writeLocal(conn net.Conn, b []byte) error {
+	if writeTimeout <= 0 {
+		_, err := conn.Write(b)
+		return err
+	}
+	defer conn.SetWriteDeadline(time.Time{})
+	for {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		n, err := conn.Write(b)
+		b = b[n:]
+		var ne net.Error
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &ne) && ne.Timeout() && n > 0:
+			continue
+		case errors.As(err, &ne) && ne.Timeout():
+			return fmt.Errorf("%w: local end read nothing for %s (-write-timeout)", errTimeout, writeTimeout)
+		}
+		return err
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pions/webrtc"
+)
+
+func withWriteTimeout(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := writeTimeout
+	writeTimeout = d
+	t.Cleanup(func() { writeTimeout = old })
+}
+
+func TestWriteLocalStuckReader(t *testing.T) {
+	withWriteTimeout(t, 100*time.Millisecond)
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	start := time.Now()
+	err := writeLocal(local, make([]byte, 1024))
+	if !errors.Is(err, errTimeout) {
+		t.Fatalf("got %v, want timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("took %s to time out", d)
+	}
+}
+
+func TestWriteLocalSlowReader(t *testing.T) {
+	withWriteTimeout(t, 100*time.Millisecond)
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	const n = 10
+	got := make(chan []byte)
+	go func() {
+		var b []byte
+		one := make([]byte, 1)
+		for len(b) < n {
+			time.Sleep(40 * time.Millisecond)
+			if _, err := remote.Read(one); err != nil {
+				break
+			}
+			b = append(b, one[0])
+		}
+		got <- b
+	}()
+	// the whole write takes 4 timeouts, each read is progress
+	if err := writeLocal(local, []byte("0123456789")); err != nil {
+		t.Fatalf("slow reader failed: %v", err)
+	}
+	if b := <-got; string(b) != "0123456789" {
+		t.Fatalf("read %q", b)
+	}
+}
+
+func TestWriteLocalWarmConn(t *testing.T) {
+	withWriteTimeout(t, 100*time.Millisecond)
+	w := newWarmConn()
+	if err := writeLocal(w, []byte("SSH-2.0-banner\r\n")); err != nil {
+		t.Fatalf("write before use: %v", err)
+	}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(io.LimitReader(remote, 16))
+		done <- b
+	}()
+	if !w.use(local) {
+		t.Fatal("use failed")
+	}
+	if b := <-done; string(b) != "SSH-2.0-banner\r\n" {
+		t.Fatalf("buffered data lost: %q", b)
+	}
+	w.Close()
+}
+
+func TestWatchWritesStuckSend(t *testing.T) {
+	withWriteTimeout(t, 100*time.Millisecond)
+	pc, err := webrtc.New(webrtc.RTCConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSession("stuck-send", pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.write.start()
+	go watchWrites(s)
+	select {
+	case <-s.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session with a blocked send not closed")
+	}
+	s.mu.Lock()
+	err = s.err
+	s.mu.Unlock()
+	if !errors.Is(err, errTimeout) {
+		t.Fatalf("got %v, want timeout", err)
+	}
+}